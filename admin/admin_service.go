@@ -0,0 +1,402 @@
+// Package admin implements the admin http api used to inspect and act on queued
+// and dead-lettered requests, and to inspect upstream nodes.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gptankit/serviceq/algorithm"
+	"github.com/gptankit/serviceq/errorlog"
+	"github.com/gptankit/serviceq/model"
+	"github.com/gptankit/serviceq/queue"
+	"github.com/gptankit/serviceq/result"
+	"github.com/gptankit/serviceq/spool"
+)
+
+const (
+	ROUTE_QUEUE       = "/queue"
+	ROUTE_DEAD_LETTER = "/dead-letter"
+	ROUTE_ENDPOINTS   = "/endpoints"
+)
+
+// AdminService serves list/get/delete/replay/purge operations on the request
+// queue (ROUTE_QUEUE) and the dead-letter queue (ROUTE_DEAD_LETTER):
+//
+//	GET    /{store}             list requests, and number of requests superseded by compaction
+//	GET    /{store}/{seq}       get request including body
+//	DELETE /{store}/{seq}       delete waiting request
+//	DELETE /{store}             purge waiting requests
+//	POST   /{store}/{seq}/replay move request to tail of request queue with fresh attempts and age
+//	POST   /{store}/replay      replay all waiting requests
+//
+// and lists upstream nodes with their load, circuit state, error score and latency on GET ROUTE_ENDPOINTS.
+type AdminService struct {
+	properties  *model.ServiceQProperties
+	q           model.Queue
+	deadLetterQ model.Queue
+	results     *result.Store
+	keys        *result.KeyStore
+}
+
+// AdminOption configures an AdminService
+type AdminOption func(*AdminService)
+
+// WithResultStore keeps polled states of replayed, deleted and purged requests up to date
+func WithResultStore(results *result.Store) AdminOption {
+
+	return func(adm *AdminService) {
+
+		adm.results = results
+	}
+}
+
+// WithKeyStore keeps idempotency keys of replayed, deleted and purged requests up to date
+func WithKeyStore(keys *result.KeyStore) AdminOption {
+
+	return func(adm *AdminService) {
+
+		adm.keys = keys
+	}
+}
+
+// entry is the admin view of a queued request
+type entry struct {
+	Seq           uint64              `json:"seq"`
+	Protocol      string              `json:"protocol"`
+	Method        string              `json:"method"`
+	URI           string              `json:"uri"`
+	Headers       map[string][]string `json:"headers"`
+	BodySize      int64               `json:"body_size"`
+	Body          []byte              `json:"body,omitempty"`
+	Attempts      int                 `json:"attempts"`
+	Priority      string              `json:"priority,omitempty"`
+	Partition     string              `json:"partition,omitempty"`
+	OrderingKey   string              `json:"ordering_key,omitempty"`
+	CompactionKey string              `json:"compaction_key,omitempty"`
+	EnqueuedAt    time.Time           `json:"enqueued_at"`
+	Age           int64               `json:"age"` // s
+}
+
+// node is the admin view of an upstream node
+type node struct {
+	URL         string            `json:"url"`
+	Weight      int64             `json:"weight"`
+	Zone        string            `json:"zone,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	MaxConns    int64             `json:"max_conns,omitempty"`
+	Backup      bool              `json:"backup,omitempty"`
+	Outstanding int64             `json:"outstanding"`
+	Circuit     string            `json:"circuit"`
+	ErrorScore  float64           `json:"error_score"`
+	Latency     latency           `json:"latency"`
+}
+
+// latency holds response times of a node in ms
+type latency struct {
+	EWMA float64 `json:"ewma"`
+	P50  float64 `json:"p50"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+}
+
+// New returns an AdminService acting on q and dlq
+func New(sqp *model.ServiceQProperties, q model.Queue, dlq model.Queue, opts ...AdminOption) *AdminService {
+
+	adm := &AdminService{
+		properties:  sqp,
+		q:           q,
+		deadLetterQ: dlq,
+	}
+	for _, opt := range opts {
+		opt(adm)
+	}
+
+	return adm
+}
+
+// ServeHTTP authorizes and routes admin requests
+func (adm *AdminService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if !adm.authorized(r) {
+		writeMsg(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var store model.Queue
+	var rest string
+	switch {
+	case r.URL.Path == ROUTE_ENDPOINTS && r.Method == http.MethodGet:
+		adm.endpoints(w)
+		return
+	case r.URL.Path == ROUTE_ENDPOINTS:
+		writeMsg(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	case r.URL.Path == ROUTE_QUEUE || strings.HasPrefix(r.URL.Path, ROUTE_QUEUE+"/"):
+		store, rest = adm.q, strings.TrimPrefix(r.URL.Path, ROUTE_QUEUE)
+	case r.URL.Path == ROUTE_DEAD_LETTER || strings.HasPrefix(r.URL.Path, ROUTE_DEAD_LETTER+"/"):
+		store, rest = adm.deadLetterQ, strings.TrimPrefix(r.URL.Path, ROUTE_DEAD_LETTER)
+	default:
+		writeMsg(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		adm.list(w, store)
+	case len(parts) == 0 && r.Method == http.MethodDelete:
+		adm.purge(w, store)
+	case len(parts) == 1 && parts[0] == "replay" && r.Method == http.MethodPost:
+		adm.replayAll(w, store)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		adm.withSeq(w, parts[0], store, adm.get)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		adm.withSeq(w, parts[0], store, adm.delete)
+	case len(parts) == 2 && parts[1] == "replay" && r.Method == http.MethodPost:
+		adm.withSeq(w, parts[0], store, adm.replay)
+	default:
+		writeMsg(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
+
+// authorized checks bearer token against ADMIN_TOKEN, if one is configured
+func (adm *AdminService) authorized(r *http.Request) bool {
+
+	if adm.properties.AdminToken == "" {
+		return true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adm.properties.AdminToken)) == 1
+}
+
+// withSeq parses seq path segment before calling op
+func (adm *AdminService) withSeq(w http.ResponseWriter, seqPart string, store model.Queue, op func(http.ResponseWriter, model.Queue, uint64)) {
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		writeMsg(w, http.StatusBadRequest, "Invalid Seq")
+		return
+	}
+
+	op(w, store, seq)
+}
+
+// list writes all requests in store
+func (adm *AdminService) list(w http.ResponseWriter, store model.Queue) {
+
+	reqParams := store.List()
+	entries := make([]entry, 0, len(reqParams))
+	for _, reqParam := range reqParams {
+		entries = append(entries, newEntry(reqParam))
+	}
+
+	listing := map[string]interface{}{"count": len(entries), "requests": entries}
+	if compactor, ok := store.(queue.Compactor); ok {
+		listing["superseded"] = compactor.Superseded()
+	}
+
+	writeJSON(w, http.StatusOK, listing)
+}
+
+// get writes a single request in store including its body
+func (adm *AdminService) get(w http.ResponseWriter, store model.Queue, seq uint64) {
+
+	for _, reqParam := range store.List() {
+		if reqParam.Seq == seq {
+			e := newEntry(reqParam)
+			body, err := readBody(reqParam)
+			if err != nil {
+				// spooled body is gone once the request was delivered or removed meanwhile
+				writeMsg(w, http.StatusNotFound, "Body Not Found")
+				return
+			}
+			e.Body = body
+			writeJSON(w, http.StatusOK, e)
+			return
+		}
+	}
+
+	writeMsg(w, http.StatusNotFound, "Not Found")
+}
+
+// delete removes a waiting request from store
+func (adm *AdminService) delete(w http.ResponseWriter, store model.Queue, seq uint64) {
+
+	reqParam, ok := store.Remove(seq)
+	if !ok {
+		writeMsg(w, http.StatusNotFound, "Not Found or In Flight")
+		return
+	}
+	spool.Release(reqParam)
+	adm.setRemoved(reqParam)
+
+	writeJSON(w, http.StatusOK, newEntry(reqParam))
+}
+
+// purge removes all waiting requests from store
+func (adm *AdminService) purge(w http.ResponseWriter, store model.Queue) {
+
+	waiting := store.List()
+	purged := store.Purge()
+
+	// release spooled bodies and states of purged requests, in flight ones are kept
+	left := make(map[uint64]bool)
+	for _, reqParam := range store.List() {
+		left[reqParam.Seq] = true
+	}
+	for _, reqParam := range waiting {
+		if !left[reqParam.Seq] {
+			spool.Release(reqParam)
+			adm.setRemoved(reqParam)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+// replay moves a request to tail of request queue with fresh attempts and age
+func (adm *AdminService) replay(w http.ResponseWriter, store model.Queue, seq uint64) {
+
+	reqParam, err := queue.Replay(store, adm.q, seq)
+	if err == queue.ErrQueueFull {
+		writeMsg(w, http.StatusServiceUnavailable, "Queue Full")
+		return
+	} else if err != nil {
+		writeMsg(w, http.StatusNotFound, "Not Found or In Flight")
+		return
+	}
+	adm.setQueued(reqParam)
+
+	writeJSON(w, http.StatusOK, newEntry(reqParam))
+}
+
+// replayAll replays all waiting requests in store
+func (adm *AdminService) replayAll(w http.ResponseWriter, store model.Queue) {
+
+	replayed := 0
+	for _, reqParam := range store.List() {
+		replayedParam, err := queue.Replay(store, adm.q, reqParam.Seq)
+		if err != nil {
+			continue
+		}
+		adm.setQueued(replayedParam)
+		replayed++
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"replayed": replayed})
+}
+
+// endpoints writes upstream nodes with their load, circuit state, error score and latency
+func (adm *AdminService) endpoints(w http.ResponseWriter) {
+
+	now := time.Now()
+	nodes := make([]node, 0, len(adm.properties.ServiceList))
+	for _, endpoint := range adm.properties.ServiceList {
+		n := node{
+			URL:        endpoint.QualifiedUrl,
+			Weight:     endpoint.Weight,
+			Zone:       endpoint.Zone,
+			Labels:     endpoint.Labels,
+			MaxConns:   endpoint.MaxConns,
+			Backup:     endpoint.Backup,
+			Circuit:    algorithm.CircuitState(adm.properties, endpoint.QualifiedUrl),
+			ErrorScore: errorlog.ErrorScore(adm.properties, endpoint.QualifiedUrl, now),
+			Latency: latency{
+				P50: algorithm.LatencyPercentile(adm.properties, endpoint.QualifiedUrl, 50),
+				P95: algorithm.LatencyPercentile(adm.properties, endpoint.QualifiedUrl, 95),
+				P99: algorithm.LatencyPercentile(adm.properties, endpoint.QualifiedUrl, 99),
+			},
+		}
+		n.Latency.EWMA, _ = algorithm.LatencyEWMA(adm.properties, endpoint.QualifiedUrl)
+		adm.properties.OSMutex.Lock()
+		n.Outstanding = adm.properties.Outstanding[endpoint.QualifiedUrl]
+		adm.properties.OSMutex.Unlock()
+		nodes = append(nodes, n)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"count": len(nodes), "endpoints": nodes})
+}
+
+// setQueued marks a replayed request queued again for status polling and its idempotency key, unless
+// the key has been taken by another request meanwhile
+func (adm *AdminService) setQueued(reqParam model.RequestParam) {
+
+	if adm.results != nil {
+		adm.results.Queued(reqParam.Id)
+	}
+	if adm.keys != nil && reqParam.IdempotencyKey != "" {
+		adm.keys.Claim(reqParam.IdempotencyKey, result.Fingerprint(reqParam), reqParam.Id)
+		adm.keys.Set(reqParam.IdempotencyKey, reqParam.Id, result.STATE_QUEUED, model.ResponseParam{})
+	}
+}
+
+// setRemoved marks a deleted or purged request removed for status polling and its idempotency key
+func (adm *AdminService) setRemoved(reqParam model.RequestParam) {
+
+	if adm.results != nil {
+		adm.results.Removed(reqParam.Id)
+	}
+	if adm.keys != nil && reqParam.IdempotencyKey != "" {
+		adm.keys.Set(reqParam.IdempotencyKey, reqParam.Id, result.STATE_REMOVED, model.ResponseParam{})
+	}
+}
+
+// newEntry maps a request to its admin view, without body
+func newEntry(reqParam model.RequestParam) entry {
+
+	e := entry{
+		Seq:           reqParam.Seq,
+		Protocol:      reqParam.Protocol,
+		Method:        reqParam.Method,
+		URI:           reqParam.RequestURI,
+		Headers:       reqParam.Headers,
+		BodySize:      queue.BodySize(reqParam),
+		Attempts:      reqParam.Attempts,
+		Priority:      reqParam.Priority,
+		Partition:     reqParam.Partition,
+		OrderingKey:   reqParam.OrderingKey,
+		CompactionKey: reqParam.CompactionKey,
+		EnqueuedAt:    reqParam.EnqueuedAt,
+		Age:           int64(time.Since(reqParam.EnqueuedAt) / time.Second),
+	}
+
+	return e
+}
+
+// readBody returns body of a request, from memory or from its spooled file
+func readBody(reqParam model.RequestParam) ([]byte, error) {
+
+	body, err := spool.Open(reqParam)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// writeJSON writes v as json response
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeMsg writes a serviceq message response
+func writeMsg(w http.ResponseWriter, statusCode int, msg string) {
+
+	writeJSON(w, statusCode, map[string]string{"sq_msg": msg})
+}
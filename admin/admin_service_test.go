@@ -0,0 +1,158 @@
+package admin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gptankit/serviceq/algorithm"
+	"github.com/gptankit/serviceq/model"
+	"github.com/gptankit/serviceq/queue"
+	"github.com/gptankit/serviceq/result"
+	"github.com/gptankit/serviceq/spool"
+)
+
+func call(adm *AdminService, method string, target string, token string) (int, map[string]interface{}) {
+
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	adm.ServeHTTP(rec, req)
+
+	var body map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+
+	return rec.Code, body
+}
+
+func TestQueueOperations(t *testing.T) {
+
+	sqp := &model.ServiceQProperties{AdminToken: "secret"}
+	q, dlq := queue.NewMemoryQueue(), queue.NewMemoryQueue()
+
+	q.Enqueue(model.RequestParam{Method: "POST", RequestURI: "/orders", BodyBuff: []byte("{}")})
+	dlq.Enqueue(model.RequestParam{Method: "PUT", RequestURI: "/orders/1", Attempts: 5})
+
+	adm := New(sqp, q, dlq)
+
+	if code, _ := call(adm, http.MethodGet, "/queue", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected %d without token, got %d\n", http.StatusUnauthorized, code)
+	}
+
+	if code, body := call(adm, http.MethodGet, "/queue", "secret"); code != http.StatusOK || body["count"] != float64(1) {
+		t.Errorf("queue not listed, code=%d, body=%v\n", code, body)
+	}
+
+	if code, body := call(adm, http.MethodGet, "/dead-letter/1", "secret"); code != http.StatusOK || body["attempts"] != float64(5) {
+		t.Errorf("dead-lettered request not returned, code=%d, body=%v\n", code, body)
+	}
+
+	if code, _ := call(adm, http.MethodPost, "/dead-letter/1/replay", "secret"); code != http.StatusOK || q.Len() != 2 || dlq.Len() != 0 {
+		t.Errorf("dead-lettered request not replayed, code=%d, q=%d, dlq=%d\n", code, q.Len(), dlq.Len())
+	}
+
+	if code, _ := call(adm, http.MethodDelete, "/queue/1", "secret"); code != http.StatusOK || q.Len() != 1 {
+		t.Errorf("queued request not deleted, code=%d, q=%d\n", code, q.Len())
+	}
+
+	if code, body := call(adm, http.MethodDelete, "/queue", "secret"); code != http.StatusOK || body["purged"] != float64(1) || q.Len() != 0 {
+		t.Errorf("queue not purged, code=%d, body=%v, q=%d\n", code, body, q.Len())
+	}
+
+	if code, _ := call(adm, http.MethodGet, "/queue/x", "secret"); code != http.StatusBadRequest {
+		t.Errorf("expected %d on invalid seq, got %d\n", http.StatusBadRequest, code)
+	}
+}
+
+func TestSpooledBody(t *testing.T) {
+
+	sqp := &model.ServiceQProperties{AdminToken: "secret"}
+	q, dlq := queue.NewMemoryQueue(), queue.NewMemoryQueue()
+
+	spooler, err := spool.New(t.TempDir(), 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqParam := model.RequestParam{Method: "POST", RequestURI: "/orders"}
+	if err := spooler.Save(&reqParam, strings.NewReader("spooled body")); err != nil || reqParam.BodyFile == "" {
+		t.Fatalf("body not spooled, err=%v\n", err)
+	}
+	q.Enqueue(reqParam)
+
+	adm := New(sqp, q, dlq)
+
+	// []byte bodies are base64 encoded in json
+	if code, body := call(adm, http.MethodGet, "/queue/1", "secret"); code != http.StatusOK || body["body"] != base64.StdEncoding.EncodeToString([]byte("spooled body")) || body["body_size"] != float64(12) {
+		t.Errorf("spooled body not returned, code=%d, body=%v\n", code, body)
+	}
+
+	spool.Release(reqParam)
+	if code, _ := call(adm, http.MethodGet, "/queue/1", "secret"); code != http.StatusNotFound {
+		t.Errorf("expected %d on released body, got %d\n", http.StatusNotFound, code)
+	}
+}
+
+func TestResultStates(t *testing.T) {
+
+	sqp := &model.ServiceQProperties{AdminToken: "secret"}
+	q, dlq := queue.NewMemoryQueue(), queue.NewMemoryQueue()
+	results, keys := result.NewStore(time.Minute), result.NewKeyStore(time.Minute)
+
+	reqParam := model.RequestParam{Id: "r1", Method: "POST", RequestURI: "/orders", IdempotencyKey: "k1"}
+	keys.Claim("k1", result.Fingerprint(reqParam), "r1")
+	keys.Set("k1", "r1", result.STATE_DEAD_LETTERED, model.ResponseParam{})
+	results.DeadLettered("r1")
+	dlq.Enqueue(reqParam)
+
+	adm := New(sqp, q, dlq, WithResultStore(results), WithKeyStore(keys))
+
+	call(adm, http.MethodPost, "/dead-letter/1/replay", "secret")
+	if res, _ := results.Get("r1"); res.State != result.STATE_QUEUED {
+		t.Errorf("expected result %s after replay, got %s\n", result.STATE_QUEUED, res.State)
+	}
+	if entry, _ := keys.Claim("k1", result.Fingerprint(reqParam), "r2"); entry.Result.State != result.STATE_QUEUED {
+		t.Errorf("expected key %s after replay, got %s\n", result.STATE_QUEUED, entry.Result.State)
+	}
+
+	call(adm, http.MethodDelete, "/queue/1", "secret")
+	if res, _ := results.Get("r1"); res.State != result.STATE_REMOVED {
+		t.Errorf("expected result %s after delete, got %s\n", result.STATE_REMOVED, res.State)
+	}
+	if entry, _ := keys.Claim("k1", result.Fingerprint(reqParam), "r2"); entry.Result.State != result.STATE_REMOVED {
+		t.Errorf("expected key %s after delete, got %s\n", result.STATE_REMOVED, entry.Result.State)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+
+	sqp := &model.ServiceQProperties{
+		ServiceList:   []model.Endpoint{{QualifiedUrl: "http://s0:80", Weight: 2, Zone: "eu-1"}},
+		ErrorScores:   map[string]model.ErrorScore{},
+		LatencyAlpha:  0.5,
+		LatencyWindow: 10,
+	}
+	algorithm.RecordLatency(sqp, "http://s0:80", 100*time.Millisecond)
+	algorithm.RecordLatency(sqp, "http://s0:80", 300*time.Millisecond)
+
+	adm := New(sqp, queue.NewMemoryQueue(), queue.NewMemoryQueue())
+
+	code, body := call(adm, http.MethodGet, "/endpoints", "")
+	if code != http.StatusOK || body["count"] != float64(1) {
+		t.Fatalf("endpoints not listed, code=%d, body=%v\n", code, body)
+	}
+	n := body["endpoints"].([]interface{})[0].(map[string]interface{})
+	lat := n["latency"].(map[string]interface{})
+	if n["weight"] != float64(2) || n["circuit"] != model.CIRCUIT_CLOSED || lat["ewma"] != float64(200) || lat["p50"] != float64(100) || lat["p99"] != float64(300) {
+		t.Errorf("endpoint not described as expected, got %v\n", n)
+	}
+
+	if code, _ := call(adm, http.MethodDelete, "/endpoints", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d on delete, got %d\n", http.StatusMethodNotAllowed, code)
+	}
+}
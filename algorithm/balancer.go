@@ -0,0 +1,289 @@
+package algorithm
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gptankit/serviceq/errorlog"
+	"github.com/gptankit/serviceq/model"
+)
+
+const (
+	STRATEGY_ERROR_WEIGHTED    = "error-weighted"
+	STRATEGY_ROUND_ROBIN       = "round-robin"
+	STRATEGY_LEAST_OUTSTANDING = "least-outstanding"
+	STRATEGY_P2C               = "p2c"
+	STRATEGY_WEIGHTED_RANDOM   = "weighted-random"
+	STRATEGY_LATENCY_WEIGHTED  = "latency-weighted"
+)
+
+// Balancer picks the upstream node for the first try of a request (LB_STRATEGY)
+type Balancer interface {
+	// Pick returns index of the selected node in sqp.ServiceList, out of candidates (at least two)
+	Pick(sqp *model.ServiceQProperties, candidates []int) int
+}
+
+// balancers holds one shared instance per strategy
+var balancers = map[string]Balancer{
+	STRATEGY_ERROR_WEIGHTED:    errorWeighted{},
+	STRATEGY_ROUND_ROBIN:       &roundRobin{},
+	STRATEGY_LEAST_OUTSTANDING: leastOutstanding{},
+	STRATEGY_P2C:               powerOfTwoChoices{},
+	STRATEGY_WEIGHTED_RANDOM:   weightedRandom{},
+	STRATEGY_LATENCY_WEIGHTED:  errorWeighted{latency: true},
+}
+
+// GetBalancer returns the balancer implementing strategy
+func GetBalancer(strategy string) (Balancer, bool) {
+
+	b, ok := balancers[strategy]
+
+	return b, ok
+}
+
+// Choose returns index of the node for try number retry of a request. First try is picked by b out of
+// eligible nodes, failed tries move on round robin from previous choice so that every node gets a chance.
+// Nodes with an open circuit are skipped while any other node is left.
+func Choose(b Balancer, sqp *model.ServiceQProperties, previous int, retry int) int {
+
+	noOfServices := len(sqp.ServiceList)
+
+	// single endpoint
+	// invalid num of endpoints
+	if noOfServices <= 1 {
+		return 0
+	}
+
+	if retry == 0 {
+		eligible := candidates(sqp)
+		if len(eligible) == 1 {
+			return eligible[0]
+		}
+		return b.Pick(sqp, eligible)
+	}
+
+	return next(sqp, previous)
+}
+
+// candidates returns nodes eligible for first try of a request. Primary nodes with a closed circuit
+// and below their max connections are preferred, backup nodes are used only once no primary is
+// eligible, then nodes at their max connections, and all nodes once every circuit is open. Nodes in
+// local zone (LB_ZONE) are preferred over the rest.
+func candidates(sqp *model.ServiceQProperties) []int {
+
+	available := availability(sqp)
+
+	sqp.OSMutex.Lock()
+	var primaries, backups, reachable []int
+	for i, endpoint := range sqp.ServiceList {
+		if !available[i] {
+			continue
+		}
+		reachable = append(reachable, i)
+		if endpoint.MaxConns > 0 && sqp.Outstanding[endpoint.QualifiedUrl] >= endpoint.MaxConns {
+			continue
+		}
+		if endpoint.Backup {
+			backups = append(backups, i)
+		} else {
+			primaries = append(primaries, i)
+		}
+	}
+	sqp.OSMutex.Unlock()
+
+	eligible := primaries
+	if len(eligible) == 0 {
+		eligible = backups
+	}
+	if len(eligible) == 0 {
+		eligible = reachable
+	}
+	if len(eligible) == 0 {
+		eligible = make([]int, len(sqp.ServiceList))
+		for i := range eligible {
+			eligible[i] = i
+		}
+	}
+
+	if sqp.LBZone != "" {
+		var local []int
+		for _, i := range eligible {
+			if sqp.ServiceList[i].Zone == sqp.LBZone {
+				local = append(local, i)
+			}
+		}
+		if len(local) > 0 {
+			return local
+		}
+	}
+
+	return eligible
+}
+
+// next returns the node after previous in round robin order, skipping nodes with an open circuit or
+// at their max connections unless all of them are
+func next(sqp *model.ServiceQProperties, previous int) int {
+
+	noOfServices := len(sqp.ServiceList)
+	available := availability(sqp)
+
+	sqp.OSMutex.Lock()
+	defer sqp.OSMutex.Unlock()
+
+	choice := previous
+	for i := 0; i < noOfServices; i++ {
+		choice = roundrobin(noOfServices, choice)
+		endpoint := sqp.ServiceList[choice]
+		if available[choice] && (endpoint.MaxConns <= 0 || sqp.Outstanding[endpoint.QualifiedUrl] < endpoint.MaxConns) {
+			return choice
+		}
+	}
+
+	return roundrobin(noOfServices, previous)
+}
+
+// availability returns whether circuit to each node would let a request through
+func availability(sqp *model.ServiceQProperties) []bool {
+
+	now := time.Now()
+	available := make([]bool, len(sqp.ServiceList))
+	for i, endpoint := range sqp.ServiceList {
+		available[i] = circuitAvailable(sqp, endpoint.QualifiedUrl, now)
+	}
+
+	return available
+}
+
+// roundRobin picks nodes in turn, each one as many times in a row as its weight
+type roundRobin struct {
+	next uint64
+}
+
+func (rr *roundRobin) Pick(sqp *model.ServiceQProperties, candidates []int) int {
+
+	total := int64(0)
+	for _, i := range candidates {
+		total += weight(sqp.ServiceList[i])
+	}
+
+	slot := int64((atomic.AddUint64(&rr.next, 1) - 1) % uint64(total))
+	for _, i := range candidates {
+		if slot < weight(sqp.ServiceList[i]) {
+			return i
+		}
+		slot -= weight(sqp.ServiceList[i])
+	}
+
+	return candidates[len(candidates)-1]
+}
+
+// leastOutstanding picks the node with fewest requests in flight relative to its weight, ties are
+// broken at random
+type leastOutstanding struct{}
+
+func (leastOutstanding) Pick(sqp *model.ServiceQProperties, candidates []int) int {
+
+	sqp.OSMutex.Lock()
+	defer sqp.OSMutex.Unlock()
+
+	start := randomize(0, len(candidates))
+	choice := candidates[start]
+	for j := 1; j < len(candidates); j++ {
+		i := candidates[(start+j)%len(candidates)]
+		if lessLoaded(sqp, i, choice) {
+			choice = i
+		}
+	}
+
+	return choice
+}
+
+// powerOfTwoChoices picks two nodes at random and takes the one with fewer requests in flight relative
+// to its weight, or lower error score on a tie
+type powerOfTwoChoices struct{}
+
+func (powerOfTwoChoices) Pick(sqp *model.ServiceQProperties, candidates []int) int {
+
+	j := randomize(0, len(candidates))
+	a := candidates[j]
+	b := candidates[(j+randomize(1, len(candidates)))%len(candidates)]
+
+	sqp.OSMutex.Lock()
+	aLess, bLess := lessLoaded(sqp, a, b), lessLoaded(sqp, b, a)
+	sqp.OSMutex.Unlock()
+	if aLess {
+		return a
+	} else if bLess {
+		return b
+	}
+
+	now := time.Now()
+	if errorlog.ErrorScore(sqp, sqp.ServiceList[b].QualifiedUrl, now) < errorlog.ErrorScore(sqp, sqp.ServiceList[a].QualifiedUrl, now) {
+		return b
+	}
+
+	return a
+}
+
+// lessLoaded determines whether node a has fewer requests in flight per unit of weight than node b,
+// caller holds sqp.OSMutex
+func lessLoaded(sqp *model.ServiceQProperties, a int, b int) bool {
+
+	endpointA, endpointB := sqp.ServiceList[a], sqp.ServiceList[b]
+
+	return sqp.Outstanding[endpointA.QualifiedUrl]*weight(endpointB) < sqp.Outstanding[endpointB.QualifiedUrl]*weight(endpointA)
+}
+
+// weightedRandom picks nodes at random in proportion to their weight
+type weightedRandom struct{}
+
+func (weightedRandom) Pick(sqp *model.ServiceQProperties, candidates []int) int {
+
+	total := int64(0)
+	for _, i := range candidates {
+		total += weight(sqp.ServiceList[i])
+	}
+
+	randx := randomize64(0, total)
+	for _, i := range candidates {
+		if randx < weight(sqp.ServiceList[i]) {
+			return i
+		}
+		randx -= weight(sqp.ServiceList[i])
+	}
+
+	return candidates[len(candidates)-1]
+}
+
+// weight returns selection weight of an endpoint, endpoints without a configured weight weigh 1
+func weight(endpoint model.Endpoint) int64 {
+
+	if endpoint.Weight <= 0 {
+		return 1
+	}
+
+	return endpoint.Weight
+}
+
+// StartRequest counts a request in flight to service, for least-outstanding and p2c strategies and max connections
+func StartRequest(sqp *model.ServiceQProperties, service string) {
+
+	sqp.OSMutex.Lock()
+	defer sqp.OSMutex.Unlock()
+
+	if sqp.Outstanding == nil {
+		sqp.Outstanding = make(map[string]int64)
+	}
+	sqp.Outstanding[service]++
+}
+
+// FinishRequest counts a request to service as no longer in flight
+func FinishRequest(sqp *model.ServiceQProperties, service string) {
+
+	sqp.OSMutex.Lock()
+	defer sqp.OSMutex.Unlock()
+
+	if sqp.Outstanding[service] > 0 {
+		sqp.Outstanding[service]--
+	}
+}
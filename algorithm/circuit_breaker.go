@@ -0,0 +1,179 @@
+package algorithm
+
+import (
+	"time"
+
+	"github.com/gptankit/serviceq/errorlog"
+	"github.com/gptankit/serviceq/model"
+)
+
+// probeWait is how long to wait on a half-open circuit whose probes are all in flight
+const probeWait = time.Second
+
+// AllowRequest determines whether a request may be sent to service. An open circuit turns half-open
+// once CIRCUIT_OPEN_TIMEOUT has passed, a half-open circuit lets up to CIRCUIT_HALF_OPEN_PROBES
+// requests through. Every allowed request is to be followed by RecordSuccess or RecordFailure.
+func AllowRequest(sqp *model.ServiceQProperties, service string) bool {
+
+	if sqp.CircuitThreshold <= 0 {
+		return true
+	}
+
+	sqp.CBMutex.Lock()
+	defer sqp.CBMutex.Unlock()
+
+	circuit := sqp.Circuits[service]
+	switch circuit.State {
+	case model.CIRCUIT_OPEN:
+		if time.Since(circuit.OpenedAt) < time.Duration(sqp.CircuitOpenTimeout)*time.Second {
+			return false
+		}
+		circuit = model.CircuitBreaker{State: model.CIRCUIT_HALF_OPEN, OpenedAt: circuit.OpenedAt}
+		fallthrough
+	case model.CIRCUIT_HALF_OPEN:
+		if circuit.Probes >= sqp.CircuitProbes {
+			return false
+		}
+		circuit.Probes++
+		setCircuit(sqp, service, circuit)
+	}
+
+	return true
+}
+
+// RecordSuccess counts a successful request to service, closing its circuit once all probes of a
+// half-open circuit succeeded
+func RecordSuccess(sqp *model.ServiceQProperties, service string) {
+
+	if sqp.CircuitThreshold <= 0 {
+		return
+	}
+
+	sqp.CBMutex.Lock()
+	defer sqp.CBMutex.Unlock()
+
+	circuit := sqp.Circuits[service]
+	switch circuit.State {
+	case model.CIRCUIT_HALF_OPEN:
+		circuit.Successes++
+		if circuit.Successes >= sqp.CircuitProbes {
+			circuit = model.CircuitBreaker{State: model.CIRCUIT_CLOSED}
+			go errorlog.LogGenericError("Circuit to " + service + " closed")
+		}
+		setCircuit(sqp, service, circuit)
+	case model.CIRCUIT_OPEN:
+		// late response of a request sent before circuit opened
+	default:
+		if circuit.Failures > 0 {
+			setCircuit(sqp, service, model.CircuitBreaker{State: model.CIRCUIT_CLOSED})
+		}
+	}
+}
+
+// RecordFailure counts a failed request to service, opening its circuit after CIRCUIT_FAILURE_THRESHOLD
+// consecutive failures or a failed probe
+func RecordFailure(sqp *model.ServiceQProperties, service string) {
+
+	if sqp.CircuitThreshold <= 0 {
+		return
+	}
+
+	sqp.CBMutex.Lock()
+	defer sqp.CBMutex.Unlock()
+
+	circuit := sqp.Circuits[service]
+	switch circuit.State {
+	case model.CIRCUIT_HALF_OPEN:
+		circuit = model.CircuitBreaker{State: model.CIRCUIT_OPEN, OpenedAt: time.Now()}
+		go errorlog.LogGenericError("Circuit to " + service + " opened again, probe failed")
+	case model.CIRCUIT_OPEN:
+		return
+	default:
+		circuit.State = model.CIRCUIT_CLOSED
+		circuit.Failures++
+		if circuit.Failures >= sqp.CircuitThreshold {
+			circuit = model.CircuitBreaker{State: model.CIRCUIT_OPEN, OpenedAt: time.Now()}
+			go errorlog.LogGenericError("Circuit to " + service + " opened")
+		}
+	}
+	setCircuit(sqp, service, circuit)
+}
+
+// CircuitState returns state of the circuit to service
+func CircuitState(sqp *model.ServiceQProperties, service string) string {
+
+	sqp.CBMutex.Lock()
+	defer sqp.CBMutex.Unlock()
+
+	if state := sqp.Circuits[service].State; state != "" {
+		return state
+	}
+
+	return model.CIRCUIT_CLOSED
+}
+
+// CircuitWait returns how long until a request may be sent to any node, 0 if it may be right away
+func CircuitWait(sqp *model.ServiceQProperties) time.Duration {
+
+	if sqp.CircuitThreshold <= 0 {
+		return 0
+	}
+
+	sqp.CBMutex.Lock()
+	defer sqp.CBMutex.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(-1)
+	for _, endpoint := range sqp.ServiceList {
+		until := untilAvailable(sqp, endpoint.QualifiedUrl, now)
+		if until <= 0 {
+			return 0
+		}
+		if wait < 0 || until < wait {
+			wait = until
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+
+	return wait
+}
+
+// circuitAvailable determines whether the circuit to service would let a request through right now
+func circuitAvailable(sqp *model.ServiceQProperties, service string, now time.Time) bool {
+
+	if sqp.CircuitThreshold <= 0 {
+		return true
+	}
+
+	sqp.CBMutex.Lock()
+	defer sqp.CBMutex.Unlock()
+
+	return untilAvailable(sqp, service, now) <= 0
+}
+
+// untilAvailable returns how long until the circuit to service lets a request through, caller holds sqp.CBMutex
+func untilAvailable(sqp *model.ServiceQProperties, service string, now time.Time) time.Duration {
+
+	circuit := sqp.Circuits[service]
+	switch circuit.State {
+	case model.CIRCUIT_OPEN:
+		return circuit.OpenedAt.Add(time.Duration(sqp.CircuitOpenTimeout) * time.Second).Sub(now)
+	case model.CIRCUIT_HALF_OPEN:
+		if circuit.Probes >= sqp.CircuitProbes {
+			return probeWait
+		}
+	}
+
+	return 0
+}
+
+// setCircuit stores circuit state of service, caller holds sqp.CBMutex
+func setCircuit(sqp *model.ServiceQProperties, service string, circuit model.CircuitBreaker) {
+
+	if sqp.Circuits == nil {
+		sqp.Circuits = make(map[string]model.CircuitBreaker)
+	}
+	sqp.Circuits[service] = circuit
+}
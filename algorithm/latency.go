@@ -0,0 +1,72 @@
+package algorithm
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
+)
+
+// RecordLatency adds response time of a request to service to its latency stats
+func RecordLatency(sqp *model.ServiceQProperties, service string, elapsed time.Duration) {
+
+	ms := float64(elapsed) / float64(time.Millisecond)
+	window := sqp.LatencyWindow
+	if window <= 0 {
+		window = 1
+	}
+
+	sqp.LTMutex.Lock()
+	defer sqp.LTMutex.Unlock()
+
+	if sqp.Latencies == nil {
+		sqp.Latencies = make(map[string]model.LatencyStats)
+	}
+	stats := sqp.Latencies[service]
+	if stats.Count == 0 {
+		stats.EWMA = ms
+	} else {
+		stats.EWMA += sqp.LatencyAlpha * (ms - stats.EWMA)
+	}
+	if len(stats.Samples) < window {
+		stats.Samples = append(stats.Samples, ms)
+	} else {
+		stats.Samples[stats.Count%uint64(window)] = ms
+	}
+	stats.Count++
+	sqp.Latencies[service] = stats
+}
+
+// LatencyEWMA returns moving average of response times (ms) of service, and whether any was recorded
+func LatencyEWMA(sqp *model.ServiceQProperties, service string) (float64, bool) {
+
+	sqp.LTMutex.Lock()
+	defer sqp.LTMutex.Unlock()
+
+	stats := sqp.Latencies[service]
+
+	return stats.EWMA, stats.Count > 0
+}
+
+// LatencyPercentile returns response time (ms) of service that p percent of latest responses
+// did not exceed, 0 if none was recorded
+func LatencyPercentile(sqp *model.ServiceQProperties, service string, p float64) float64 {
+
+	sqp.LTMutex.Lock()
+	samples := append([]float64(nil), sqp.Latencies[service].Samples...)
+	sqp.LTMutex.Unlock()
+
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Float64s(samples)
+	rank := int(math.Ceil(p/100*float64(len(samples)))) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(samples) {
+		rank = len(samples) - 1
+	}
+
+	return samples[rank]
+}
@@ -2,9 +2,11 @@ package algorithm
 
 import (
 	"math/rand"
-	"time"
 )
 
+// Helpers below draw from the global source, which the runtime seeds and guards. Reseeding
+// it on every pick would make concurrent picks within the same clock tick collide.
+
 // randomize implements randomized selection where init is
 // lower selection limit and set is total selection space.
 func randomize(init int, set int) int {
@@ -13,7 +15,6 @@ func randomize(init int, set int) int {
 		return 0
 	}
 
-	rand.Seed(time.Now().UTC().UnixNano())
 	choice := rand.Intn(set-init) + init
 
 	return choice
@@ -26,8 +27,19 @@ func randomize64(init int64, set int64) int64 {
 		return int64(0)
 	}
 
-	rand.Seed(time.Now().UTC().UnixNano())
 	choice := rand.Int63n(set-init) + init
 
 	return choice
 }
+
+// randomizeFloat returns a random number in [0, set).
+func randomizeFloat(set float64) float64 {
+
+	if set <= 0 {
+		return 0
+	}
+
+	choice := rand.Float64() * set
+
+	return choice
+}
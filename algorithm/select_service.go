@@ -2,69 +2,78 @@ package algorithm
 
 import (
 	"math"
+	"time"
 
+	"github.com/gptankit/serviceq/errorlog"
 	"github.com/gptankit/serviceq/model"
 )
 
 // ChooseServiceIndex implements the routing logic to the cluster of upstream services. On
-// first try, an error log lookup is done to determine the service-wise error count and effective
-// error is calculated. If no error found for any service, random service selection (equal probability)
-// is done, else weighted random service selection is done, where weights are inversely proportional
-// to error count on the particular service. If the request to the selected service fails, round robin
-// selection is done to deterministically select the next service.
+// first try, decayed error scores of the services are looked up and weighted random service
+// selection is done, where weights are proportional to configured endpoint weights and inversely
+// proportional to (1 + error score) raised to ERROR_EXPONENT. As scores halve every ERROR_HALF_LIFE,
+// a failing service gets its share back gradually. With latency-weighted strategy, weights are also
+// inversely proportional to latency EWMA of the service. If the request to the selected service fails,
+// round robin selection is done to deterministically select the next service.
 func ChooseServiceIndex(sqp *model.ServiceQProperties, initialChoice int, retry int) int {
 
-	noOfServices := len(sqp.ServiceList)
+	return Choose(errorWeighted{latency: sqp.LBStrategy == STRATEGY_LATENCY_WEIGHTED}, sqp, initialChoice, retry)
+}
+
+// errorWeighted picks nodes at random, weighted by their configured weight and inversely to their error
+// score. With latency set, weights are also inversely proportional to latency EWMA relative to the fastest
+// candidate, nodes without recorded responses count as fastest.
+type errorWeighted struct {
+	latency bool
+}
+
+func (ew errorWeighted) Pick(sqp *model.ServiceQProperties, candidates []int) int {
 
-	// single endpoint
-	// invalid num of endpoints
-	if noOfServices <= 1 {
-		return 0
+	now := time.Now()
+	weights := make([]float64, len(candidates))
+	for j, i := range candidates {
+		score := errorlog.ErrorScore(sqp, sqp.ServiceList[i].QualifiedUrl, now)
+		weights[j] = float64(weight(sqp.ServiceList[i])) / math.Pow(1+score, sqp.ErrorExponent)
 	}
 
-	if retry == 0 { // first time
-		sqp.REMutex.Lock()
-		defer sqp.REMutex.Unlock()
-		maxErr := uint64(0)
-		for _, n := range sqp.ServiceList {
-			errCnt := sqp.RequestErrorLog[n.QualifiedUrl]
-			effectiveErr := uint64(math.Floor(math.Pow(float64(1+errCnt), 1.5)))
-			if effectiveErr >= maxErr {
-				maxErr = effectiveErr
+	if ew.latency {
+		ewmas := make([]float64, len(candidates))
+		fastest := math.Inf(1)
+		for j, i := range candidates {
+			if ewma, ok := LatencyEWMA(sqp, sqp.ServiceList[i].QualifiedUrl); ok && ewma > 0 {
+				ewmas[j] = ewma
+				fastest = math.Min(fastest, ewma)
 			}
 		}
-		if maxErr == 1 {
-			return randomize(0, noOfServices)
-		} else {
-			weights := make([]float64, noOfServices)
-			prefixes := make([]float64, noOfServices)
-			for i, n := range sqp.ServiceList {
-				errCnt := sqp.RequestErrorLog[n.QualifiedUrl]
-				weights[i] = math.Ceil(float64(maxErr) / float64(errCnt+1))
-			}
-			for i, _ := range weights {
-				if i == 0 {
-					prefixes[i] = weights[i]
-				} else {
-					prefixes[i] = weights[i] + prefixes[i-1]
-				}
-			}
-			prLen := noOfServices - 1
-			randx := randomize64(1, int64(prefixes[prLen])+1)
-			ceil := findCeilIn(randx, prefixes, 0, prLen)
-			if ceil >= 0 {
-				return ceil
+		for j := range candidates {
+			if ewmas[j] > 0 {
+				weights[j] *= fastest / ewmas[j]
 			}
 		}
-		return randomize(0, noOfServices)
-	} else {
-		return roundrobin(noOfServices, initialChoice)
 	}
+
+	prefixes := make([]float64, len(candidates))
+	for j := range weights {
+		if j == 0 {
+			prefixes[j] = weights[j]
+		} else {
+			prefixes[j] = weights[j] + prefixes[j-1]
+		}
+	}
+
+	prLen := len(candidates) - 1
+	randx := randomizeFloat(prefixes[prLen])
+	ceil := findCeilIn(randx, prefixes, 0, prLen)
+	if ceil >= 0 {
+		return candidates[ceil]
+	}
+
+	return candidates[randomize(0, len(candidates))]
 }
 
 // findCeilIn does a binary search to find position of selected random
 // number and returns corresponding ceil index in prefixes array
-func findCeilIn(randx int64, prefixes []float64, start int, end int) int {
+func findCeilIn(randx float64, prefixes []float64, start int, end int) int {
 
 	var mid int
 	for {
@@ -72,14 +81,14 @@ func findCeilIn(randx int64, prefixes []float64, start int, end int) int {
 			break
 		}
 		mid = start + ((end - start) >> 1)
-		if randx > int64(prefixes[mid]) {
+		if randx >= prefixes[mid] {
 			start = mid + 1
 		} else {
 			end = mid
 		}
 	}
 
-	if randx <= int64(prefixes[start]) {
+	if randx < prefixes[start] {
 		return start
 	}
 	return -1
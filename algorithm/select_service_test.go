@@ -2,6 +2,7 @@ package algorithm
 
 import (
 	"testing"
+	"time"
 
 	"github.com/gptankit/serviceq/model"
 )
@@ -14,7 +15,7 @@ func TestServiceIndexWithinBoundR1(t *testing.T) {
 		rt  int
 	}{
 		{&model.ServiceQProperties{
-			RequestErrorLog: map[string]uint64{"s0": 1, "s1": 2},
+			ErrorScores: map[string]model.ErrorScore{"s0": {Value: 1}, "s1": {Value: 2}},
 			ServiceList: []model.Endpoint{
 				model.Endpoint{QualifiedUrl: "s0"},
 				model.Endpoint{QualifiedUrl: "s1"},
@@ -22,7 +23,7 @@ func TestServiceIndexWithinBoundR1(t *testing.T) {
 			5,
 			0},
 		{&model.ServiceQProperties{
-			RequestErrorLog: map[string]uint64{"s0": 1, "s1": 2},
+			ErrorScores: map[string]model.ErrorScore{"s0": {Value: 1}, "s1": {Value: 2}},
 			ServiceList: []model.Endpoint{
 				model.Endpoint{QualifiedUrl: "s0"},
 				model.Endpoint{QualifiedUrl: "s1"},
@@ -30,7 +31,7 @@ func TestServiceIndexWithinBoundR1(t *testing.T) {
 			8,
 			0},
 		{&model.ServiceQProperties{
-			RequestErrorLog: map[string]uint64{"s0": 1, "s1": 2},
+			ErrorScores: map[string]model.ErrorScore{"s0": {Value: 1}, "s1": {Value: 2}},
 			ServiceList: []model.Endpoint{
 				model.Endpoint{QualifiedUrl: "s0"},
 				model.Endpoint{QualifiedUrl: "s1"},
@@ -38,7 +39,7 @@ func TestServiceIndexWithinBoundR1(t *testing.T) {
 			1,
 			0},
 		{&model.ServiceQProperties{
-			RequestErrorLog: map[string]uint64{"s0": 1, "s1": 2},
+			ErrorScores: map[string]model.ErrorScore{"s0": {Value: 1}, "s1": {Value: 2}},
 			ServiceList: []model.Endpoint{
 				model.Endpoint{QualifiedUrl: "s0"},
 				model.Endpoint{QualifiedUrl: "s1"},
@@ -67,7 +68,7 @@ func TestServiceIndexWithinBoundRn(t *testing.T) {
 		rt  int
 	}{
 		{&model.ServiceQProperties{
-			RequestErrorLog: map[string]uint64{"s0": 1, "s1": 2},
+			ErrorScores: map[string]model.ErrorScore{"s0": {Value: 1}, "s1": {Value: 2}},
 			ServiceList: []model.Endpoint{
 				model.Endpoint{QualifiedUrl: "s0"},
 				model.Endpoint{QualifiedUrl: "s1"},
@@ -75,7 +76,7 @@ func TestServiceIndexWithinBoundRn(t *testing.T) {
 			59,
 			3},
 		{&model.ServiceQProperties{
-			RequestErrorLog: map[string]uint64{"s0": 1, "s1": 2},
+			ErrorScores: map[string]model.ErrorScore{"s0": {Value: 1}, "s1": {Value: 2}},
 			ServiceList: []model.Endpoint{
 				model.Endpoint{QualifiedUrl: "s0"},
 				model.Endpoint{QualifiedUrl: "s1"},
@@ -83,7 +84,7 @@ func TestServiceIndexWithinBoundRn(t *testing.T) {
 			8,
 			2},
 		{&model.ServiceQProperties{
-			RequestErrorLog: map[string]uint64{"s0": 1, "s1": 2},
+			ErrorScores: map[string]model.ErrorScore{"s0": {Value: 1}, "s1": {Value: 2}},
 			ServiceList: []model.Endpoint{
 				model.Endpoint{QualifiedUrl: "s0"},
 				model.Endpoint{QualifiedUrl: "s1"},
@@ -91,7 +92,7 @@ func TestServiceIndexWithinBoundRn(t *testing.T) {
 			14,
 			-1},
 		{&model.ServiceQProperties{
-			RequestErrorLog: map[string]uint64{"s0": 1, "s1": 2},
+			ErrorScores: map[string]model.ErrorScore{"s0": {Value: 1}, "s1": {Value: 2}},
 			ServiceList: []model.Endpoint{
 				model.Endpoint{QualifiedUrl: "s0"},
 				model.Endpoint{QualifiedUrl: "s1"},
@@ -111,3 +112,226 @@ func TestServiceIndexWithinBoundRn(t *testing.T) {
 		}
 	}
 }
+
+func TestBalancers(t *testing.T) {
+
+	sqp := &model.ServiceQProperties{
+		ErrorScores: map[string]model.ErrorScore{"s1": {Value: 4}}, ErrorExponent: 1.5,
+		ServiceList: []model.Endpoint{
+			model.Endpoint{QualifiedUrl: "s0"},
+			model.Endpoint{QualifiedUrl: "s1"},
+			model.Endpoint{QualifiedUrl: "s2"},
+		},
+	}
+	StartRequest(sqp, "s0")
+	StartRequest(sqp, "s0")
+	StartRequest(sqp, "s2")
+
+	for _, strategy := range []string{STRATEGY_ERROR_WEIGHTED, STRATEGY_ROUND_ROBIN, STRATEGY_LEAST_OUTSTANDING, STRATEGY_P2C, STRATEGY_WEIGHTED_RANDOM} {
+		b, ok := GetBalancer(strategy)
+		if !ok {
+			t.Fatalf("Balancer %s not found", strategy)
+		}
+		for i := 0; i < 20; i++ {
+			if ce := Choose(b, sqp, i%3, i%2); ce < 0 || ce >= 3 {
+				t.Errorf("%s: service index out of bound --> ce=%d\n", strategy, ce)
+			}
+		}
+	}
+
+	// s1 weighs 1/(1+4)^1.5 of the others
+	ew, _ := GetBalancer(STRATEGY_ERROR_WEIGHTED)
+	failing := 0
+	for i := 0; i < 300; i++ {
+		if ew.Pick(sqp, []int{0, 1, 2}) == 1 {
+			failing++
+		}
+	}
+	if failing > 50 {
+		t.Errorf("error-weighted picked failing s1 %d times out of 300", failing)
+	}
+
+	if b, _ := GetBalancer(STRATEGY_LEAST_OUTSTANDING); b.Pick(sqp, []int{0, 1, 2}) != 1 {
+		t.Errorf("least-outstanding should pick s1 with no requests in flight")
+	}
+
+	rr, _ := GetBalancer(STRATEGY_ROUND_ROBIN)
+	first := rr.Pick(sqp, []int{0, 1, 2})
+	if second := rr.Pick(sqp, []int{0, 1, 2}); second != (first+1)%3 {
+		t.Errorf("round-robin should pick %d after %d, got %d", (first+1)%3, first, second)
+	}
+
+	// with two nodes, p2c always compares both
+	pair := &model.ServiceQProperties{
+		ErrorScores: map[string]model.ErrorScore{},
+		ServiceList: sqp.ServiceList[:2],
+		Outstanding: map[string]int64{"s0": 3, "s1": 1},
+	}
+	if b, _ := GetBalancer(STRATEGY_P2C); b.Pick(pair, []int{0, 1}) != 1 {
+		t.Errorf("p2c should pick less loaded s1")
+	}
+
+	FinishRequest(sqp, "s0")
+	if sqp.Outstanding["s0"] != 1 {
+		t.Errorf("Expected 1 request in flight on s0, got %d", sqp.Outstanding["s0"])
+	}
+}
+
+func TestEndpointAttributes(t *testing.T) {
+
+	sqp := &model.ServiceQProperties{
+		ErrorScores: map[string]model.ErrorScore{},
+		ServiceList: []model.Endpoint{
+			model.Endpoint{QualifiedUrl: "s0", Weight: 3, Zone: "eu-1", MaxConns: 1},
+			model.Endpoint{QualifiedUrl: "s1", Weight: 1, Zone: "eu-2"},
+			model.Endpoint{QualifiedUrl: "s2", Weight: 1, Zone: "eu-1", Backup: true},
+		},
+	}
+
+	rr, _ := GetBalancer(STRATEGY_ROUND_ROBIN)
+	picks := map[int]int{}
+	for i := 0; i < 8; i++ {
+		picks[Choose(rr, sqp, 0, 0)]++
+	}
+	if picks[0] != 6 || picks[1] != 2 || picks[2] != 0 {
+		t.Errorf("round-robin should follow weights 3:1 and skip backup, got %v", picks)
+	}
+
+	sqp.LBZone = "eu-1"
+	for _, strategy := range []string{STRATEGY_ERROR_WEIGHTED, STRATEGY_LEAST_OUTSTANDING, STRATEGY_P2C, STRATEGY_WEIGHTED_RANDOM} {
+		b, _ := GetBalancer(strategy)
+		if ce := Choose(b, sqp, 0, 0); ce != 0 {
+			t.Errorf("%s: should pick s0 in local zone, got %d", strategy, ce)
+		}
+	}
+
+	// s0 at max connections, s1 is the only primary left
+	StartRequest(sqp, "s0")
+	if ce := Choose(rr, sqp, 0, 0); ce != 1 {
+		t.Errorf("should skip s0 at max connections, got %d", ce)
+	}
+	if ce := Choose(rr, sqp, 2, 1); ce != 1 {
+		t.Errorf("retry should skip s0 at max connections, got %d", ce)
+	}
+
+	// no primary left, backup takes over
+	sqp.ServiceList[1].MaxConns = 1
+	StartRequest(sqp, "s1")
+	if ce := Choose(rr, sqp, 0, 0); ce != 2 {
+		t.Errorf("should pick backup s2 once primaries are full, got %d", ce)
+	}
+}
+
+func TestLatency(t *testing.T) {
+
+	sqp := &model.ServiceQProperties{
+		ErrorScores: map[string]model.ErrorScore{},
+		ServiceList: []model.Endpoint{
+			model.Endpoint{QualifiedUrl: "s0"},
+			model.Endpoint{QualifiedUrl: "s1"},
+		},
+		LatencyAlpha:  0.5,
+		LatencyWindow: 4,
+	}
+
+	for _, ms := range []time.Duration{40, 10, 20, 30, 50} {
+		RecordLatency(sqp, "s1", ms*time.Millisecond)
+	}
+	RecordLatency(sqp, "s0", 10*time.Millisecond)
+
+	if ewma, ok := LatencyEWMA(sqp, "s1"); !ok || ewma != 38.125 {
+		t.Errorf("Expected latency ewma 38.125 on s1, got %f", ewma)
+	}
+	// 40 dropped out of window
+	if p50, p100 := LatencyPercentile(sqp, "s1", 50), LatencyPercentile(sqp, "s1", 100); p50 != 20 || p100 != 50 {
+		t.Errorf("Expected p50 20 and p100 50 on s1, got %f and %f", p50, p100)
+	}
+	if _, ok := LatencyEWMA(sqp, "s2"); ok {
+		t.Errorf("Expected no latency recorded on s2")
+	}
+
+	// s1 weighs 10/38.125 of s0
+	lw, _ := GetBalancer(STRATEGY_LATENCY_WEIGHTED)
+	slow := 0
+	for i := 0; i < 300; i++ {
+		if Choose(lw, sqp, 0, 0) == 1 {
+			slow++
+		}
+	}
+	if slow > 120 {
+		t.Errorf("latency-weighted picked slow s1 %d times out of 300", slow)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+
+	sqp := &model.ServiceQProperties{
+		ErrorScores: map[string]model.ErrorScore{},
+		ServiceList: []model.Endpoint{
+			model.Endpoint{QualifiedUrl: "s0"},
+			model.Endpoint{QualifiedUrl: "s1"},
+		},
+		CircuitThreshold:   2,
+		CircuitOpenTimeout: 30,
+		CircuitProbes:      2,
+	}
+
+	// a success in between keeps circuit closed
+	RecordFailure(sqp, "s0")
+	RecordSuccess(sqp, "s0")
+	RecordFailure(sqp, "s0")
+	if state := CircuitState(sqp, "s0"); state != model.CIRCUIT_CLOSED {
+		t.Errorf("Expected closed circuit, got %s", state)
+	}
+
+	RecordFailure(sqp, "s0")
+	if state := CircuitState(sqp, "s0"); state != model.CIRCUIT_OPEN || AllowRequest(sqp, "s0") {
+		t.Errorf("Expected open circuit rejecting requests, got %s", state)
+	}
+
+	rr, _ := GetBalancer(STRATEGY_ROUND_ROBIN)
+	for i := 0; i < 4; i++ {
+		if ce := Choose(rr, sqp, 0, i%2); ce != 1 {
+			t.Errorf("Expected s0 with open circuit to be skipped, got %d", ce)
+		}
+	}
+	if wait := CircuitWait(sqp); wait != 0 {
+		t.Errorf("Expected no wait while s1 is closed, got %s", wait)
+	}
+
+	RecordFailure(sqp, "s1")
+	RecordFailure(sqp, "s1")
+	if wait := CircuitWait(sqp); wait <= 0 || wait > 30*time.Second {
+		t.Errorf("Expected wait until open timeout with all circuits open, got %s", wait)
+	}
+
+	// open timeout passed, two probes let through
+	s0 := sqp.Circuits["s0"]
+	s0.OpenedAt = s0.OpenedAt.Add(-30 * time.Second)
+	sqp.Circuits["s0"] = s0
+	if !AllowRequest(sqp, "s0") || !AllowRequest(sqp, "s0") || AllowRequest(sqp, "s0") {
+		t.Errorf("Expected half-open circuit to let exactly 2 probes through")
+	}
+	if state := CircuitState(sqp, "s0"); state != model.CIRCUIT_HALF_OPEN {
+		t.Errorf("Expected half-open circuit, got %s", state)
+	}
+
+	RecordSuccess(sqp, "s0")
+	if state := CircuitState(sqp, "s0"); state != model.CIRCUIT_HALF_OPEN {
+		t.Errorf("Expected half-open circuit until all probes succeed, got %s", state)
+	}
+	RecordSuccess(sqp, "s0")
+	if state := CircuitState(sqp, "s0"); state != model.CIRCUIT_CLOSED || !AllowRequest(sqp, "s0") {
+		t.Errorf("Expected closed circuit after probes succeeded, got %s", state)
+	}
+
+	// failed probe opens circuit again
+	s1 := sqp.Circuits["s1"]
+	s1.OpenedAt = s1.OpenedAt.Add(-30 * time.Second)
+	sqp.Circuits["s1"] = s1
+	AllowRequest(sqp, "s1")
+	RecordFailure(sqp, "s1")
+	if state := CircuitState(sqp, "s1"); state != model.CIRCUIT_OPEN || AllowRequest(sqp, "s1") {
+		t.Errorf("Expected circuit open again after failed probe, got %s", state)
+	}
+}
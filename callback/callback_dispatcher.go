@@ -0,0 +1,219 @@
+// Package callback delivers outcomes of buffered requests to client supplied webhooks.
+package callback
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gptankit/serviceq/errorlog"
+	"github.com/gptankit/serviceq/model"
+)
+
+const (
+	HEADER_CALLBACK_URL = "X-SQ-Callback-URL"
+	HEADER_SIGNATURE    = "X-SQ-Signature"
+	HEADER_TIMESTAMP    = "X-SQ-Timestamp"
+
+	maxRetryGap = 10 * time.Minute
+)
+
+// Payload is posted to the callback url once a buffered request is delivered or dead-lettered
+type Payload struct {
+	RequestId string              `json:"sq_request_id"`
+	State     string              `json:"sq_state"`
+	Method    string              `json:"method"`
+	URI       string              `json:"uri"`
+	Status    string              `json:"status,omitempty"`
+	Headers   map[string][]string `json:"headers,omitempty"`
+	Body      []byte              `json:"body,omitempty"`
+}
+
+// Dispatcher posts payloads to callback urls, retrying with exponential backoff. Callback urls come
+// from clients, so they are limited to Q_CALLBACK_ALLOWED_HOSTS (if set), and connections to loopback,
+// private and link-local addresses are refused at dial time unless the host is allowed by exact name.
+type Dispatcher struct {
+	client       *http.Client
+	secret       []byte
+	maxAttempts  int
+	retryGap     time.Duration
+	allowedHosts []string
+}
+
+// NewDispatcher returns a Dispatcher configured from sq.properties
+func NewDispatcher(sqp *model.ServiceQProperties) *Dispatcher {
+
+	d := &Dispatcher{
+		secret:       []byte(sqp.QCallbackSecret),
+		maxAttempts:  sqp.QCallbackMaxAttempts,
+		retryGap:     time.Duration(sqp.QCallbackRetryGap) * time.Second,
+		allowedHosts: sqp.QCallbackAllowedHosts,
+	}
+	d.client = &http.Client{
+		Transport: &http.Transport{DialContext: d.dial}, // no proxy, it would dial in our place
+		Timeout:   time.Duration(sqp.QCallbackTimeout) * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse // a redirect could lead anywhere
+		},
+	}
+
+	return d
+}
+
+// ValidURL determines whether a callback url is an absolute http(s) url to an allowed host
+func (d *Dispatcher) ValidURL(callbackURL string) bool {
+
+	uri, err := url.ParseRequestURI(callbackURL)
+	if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") || uri.Hostname() == "" {
+		return false
+	}
+
+	if len(d.allowedHosts) == 0 {
+		return true
+	}
+	host := strings.ToLower(uri.Hostname())
+	for _, allowed := range d.allowedHosts {
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dial connects to callback host on one of its resolved addresses, refusing non-public addresses unless
+// host is allowed by exact name. Addresses are checked after resolution, so a public name cannot lead
+// to an internal address.
+func (d *Dispatcher) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	trusted := false
+	for _, allowed := range d.allowedHosts {
+		trusted = trusted || strings.ToLower(host) == allowed
+	}
+	for _, ipAddr := range ipAddrs {
+		if !trusted && !publicIP(ipAddr.IP) {
+			return nil, errors.New("callback host " + host + " resolves to non-public address " + ipAddr.IP.String())
+		}
+	}
+
+	dialer := &net.Dialer{}
+	lastErr := errors.New("no address for callback host " + host)
+	for _, ipAddr := range ipAddrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ipAddr.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// publicIP determines whether ip is routable on the internet, i.e. not loopback, private, link-local,
+// multicast or unspecified
+func publicIP(ip net.IP) bool {
+
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// Sign returns hex encoded HMAC-SHA256 of timestamp and body, as sent in HEADER_SIGNATURE.
+// Receivers recompute it over "<X-SQ-Timestamp>.<body>" to verify the sender.
+func Sign(secret []byte, timestamp string, body []byte) string {
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send asynchronously posts outcome of a buffered request to its callback url, if it has one
+func (d *Dispatcher) Send(ctx context.Context, reqParam model.RequestParam, state string, resParam model.ResponseParam) {
+
+	if reqParam.CallbackURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(Payload{
+		RequestId: reqParam.Id,
+		State:     state,
+		Method:    reqParam.Method,
+		URI:       reqParam.RequestURI,
+		Status:    resParam.Status,
+		Headers:   resParam.Headers,
+		Body:      resParam.BodyBuff,
+	})
+	if err != nil {
+		return
+	}
+
+	go func() {
+		if err := d.deliver(ctx, reqParam.CallbackURL, body); err != nil {
+			errorlog.LogGenericError("Could not deliver callback to " + reqParam.CallbackURL + " for request " + reqParam.Id + " -- " + err.Error())
+		}
+	}()
+}
+
+// deliver posts body to callback url until it answers 2xx, maxAttempts is reached or ctx is done
+func (d *Dispatcher) deliver(ctx context.Context, callbackURL string, body []byte) error {
+
+	gap := d.retryGap
+	var lastErr error
+
+	for attempt := 0; attempt < d.maxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(gap):
+			}
+			if gap *= 2; gap > maxRetryGap {
+				gap = maxRetryGap
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(HEADER_TIMESTAMP, timestamp)
+		if len(d.secret) > 0 {
+			req.Header.Set(HEADER_SIGNATURE, Sign(d.secret, timestamp, body))
+		}
+
+		resp, err := d.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = errors.New("callback responded " + resp.Status)
+	}
+
+	return lastErr
+}
@@ -0,0 +1,94 @@
+package callback
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
+)
+
+func TestSignedDeliveryWithRetry(t *testing.T) {
+
+	secret := "s3cret"
+	calls := 0
+	received := make(chan Payload, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(HEADER_SIGNATURE) != Sign([]byte(secret), r.Header.Get(HEADER_TIMESTAMP), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var payload Payload
+		json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer srv.Close()
+
+	d := NewDispatcher(&model.ServiceQProperties{QCallbackSecret: secret, QCallbackMaxAttempts: 3, QCallbackTimeout: 1, QCallbackAllowedHosts: []string{"127.0.0.1"}})
+	d.retryGap = 10 * time.Millisecond
+
+	reqParam := model.RequestParam{Id: "r1", Method: "POST", RequestURI: "/orders", CallbackURL: srv.URL}
+	d.Send(context.Background(), reqParam, "delivered", model.ResponseParam{Status: "201 Created", BodyBuff: []byte(`{"id":1}`)})
+
+	select {
+	case payload := <-received:
+		if payload.RequestId != "r1" || payload.Status != "201 Created" || string(payload.Body) != `{"id":1}` {
+			t.Errorf("unexpected callback payload %v\n", payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("callback not delivered after retry, calls=%d\n", calls)
+	}
+}
+
+func TestValidURL(t *testing.T) {
+
+	d := NewDispatcher(&model.ServiceQProperties{})
+	for u, valid := range map[string]bool{"https://hooks.example.org/sq": true, "ftp://example.org": false, "/relative": false, "": false} {
+		if d.ValidURL(u) != valid {
+			t.Errorf("ValidURL(%q) != %t\n", u, valid)
+		}
+	}
+
+	d = NewDispatcher(&model.ServiceQProperties{QCallbackAllowedHosts: []string{"hooks.example.org", "*.example.net"}})
+	for u, valid := range map[string]bool{"https://hooks.example.org/sq": true, "https://a.example.net/sq": true, "https://example.net/sq": false, "http://127.0.0.1:5253/queue/replay": false} {
+		if d.ValidURL(u) != valid {
+			t.Errorf("ValidURL(%q) != %t with allowed hosts\n", u, valid)
+		}
+	}
+}
+
+func TestNonPublicAddressRefused(t *testing.T) {
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer srv.Close()
+
+	// loopback (e.g. the admin api) is refused at dial time, also when given by name
+	d := NewDispatcher(&model.ServiceQProperties{QCallbackMaxAttempts: 1, QCallbackTimeout: 1})
+	for _, u := range []string{srv.URL, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)} {
+		if err := d.deliver(context.Background(), u, []byte("{}")); err == nil || calls != 0 {
+			t.Errorf("expected callback to %s refused, err=%v, calls=%d\n", u, err, calls)
+		}
+	}
+
+	for ip, public := range map[string]bool{"8.8.8.8": true, "10.1.2.3": false, "192.168.0.1": false, "169.254.169.254": false, "::1": false, "fd00::1": false} {
+		if publicIP(net.ParseIP(ip)) != public {
+			t.Errorf("publicIP(%s) != %t\n", ip, public)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package errorlog
 
 import (
-	"github.com/gptankit/serviceq/model"
 	"log"
+	"math"
 	"os"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
 )
 
 var logger *log.Logger
@@ -18,21 +21,24 @@ func init() {
 	}
 }
 
-// IncrementErrorCount increments session error count and logs corresponding to service.
+// IncrementErrorCount adds an error to the decaying error score and logs corresponding to service.
 func IncrementErrorCount(sqp *model.ServiceQProperties, service string, errType int, errReason string) {
 
+	now := time.Now()
 	sqp.REMutex.Lock()
-	sqp.RequestErrorLog[service] += 1
+	score := decay(sqp.ErrorScores[service], now, sqp.ErrorHalfLife)
+	sqp.ErrorScores[service] = model.ErrorScore{Value: score + 1, UpdatedAt: now}
 	sqp.REMutex.Unlock()
 	logServiceError(service, errType, errReason)
 }
 
-// ResetErrorCount resets session error count corresponding to service.
-func ResetErrorCount(sqp *model.ServiceQProperties, service string) {
+// ErrorScore returns error score of service decayed until now.
+func ErrorScore(sqp *model.ServiceQProperties, service string, now time.Time) float64 {
 
 	sqp.REMutex.Lock()
-	sqp.RequestErrorLog[service] = 0
-	sqp.REMutex.Unlock()
+	defer sqp.REMutex.Unlock()
+
+	return decay(sqp.ErrorScores[service], now, sqp.ErrorHalfLife)
 }
 
 // LogGenericError logs any given error data in the log file.
@@ -50,3 +56,14 @@ func logServiceError(service string, errType int, errReason string) {
 		logger.Printf("Error detected on %s [Code: %d, %s]", service, errType, errReason)
 	}
 }
+
+// decay returns value of score at now, halved every halfLife (s) since it was last updated.
+func decay(score model.ErrorScore, now time.Time, halfLife int) float64 {
+
+	elapsed := now.Sub(score.UpdatedAt).Seconds()
+	if score.Value == 0 || halfLife <= 0 || elapsed <= 0 {
+		return score.Value
+	}
+
+	return score.Value * math.Exp2(-elapsed/float64(halfLife))
+}
@@ -1,16 +1,18 @@
 package errorlog
 
 import (
-	"github.com/gptankit/serviceq/model"
+	"math"
 	"testing"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
 )
 
 func BenchmarkConcurrentErrorIncrements(b *testing.B) {
 
 	sqp := model.ServiceQProperties{}
-	sqp.RequestErrorLog = make(map[string]uint64, 1)
-
-	sqp.RequestErrorLog["s0"] = 0
+	sqp.ErrorScores = make(map[string]model.ErrorScore, 1)
+	sqp.ErrorHalfLife = 30
 
 	// concurrent access to map
 	for i := 0; i < b.N; i++ {
@@ -21,12 +23,33 @@ func BenchmarkConcurrentErrorIncrements(b *testing.B) {
 func BenchmarkSequentialErrorIncrements(b *testing.B) {
 
 	sqp := model.ServiceQProperties{}
-	sqp.RequestErrorLog = make(map[string]uint64, 1)
-
-	sqp.RequestErrorLog["s0"] = 0
+	sqp.ErrorScores = make(map[string]model.ErrorScore, 1)
+	sqp.ErrorHalfLife = 30
 
 	// sequential access to map
 	for i := 0; i < b.N; i++ {
 		IncrementErrorCount(&sqp, "s0", 1, "SERVICE_DOWN")
 	}
 }
+
+func TestErrorScoreDecay(t *testing.T) {
+
+	sqp := model.ServiceQProperties{ErrorScores: make(map[string]model.ErrorScore, 1), ErrorHalfLife: 10}
+
+	IncrementErrorCount(&sqp, "s0", 1, "SERVICE_DOWN")
+	IncrementErrorCount(&sqp, "s0", 1, "SERVICE_DOWN")
+	now := sqp.ErrorScores["s0"].UpdatedAt
+
+	if score := ErrorScore(&sqp, "s0", now); math.Abs(score-2) > 0.01 {
+		t.Errorf("Expected score 2 right after errors, got %f", score)
+	}
+	if score := ErrorScore(&sqp, "s0", now.Add(10*time.Second)); math.Abs(score-1) > 0.01 {
+		t.Errorf("Expected score 1 after a half-life, got %f", score)
+	}
+	if score := ErrorScore(&sqp, "s0", now.Add(30*time.Second)); math.Abs(score-0.25) > 0.01 {
+		t.Errorf("Expected score 0.25 after three half-lives, got %f", score)
+	}
+	if score := ErrorScore(&sqp, "s1", now); score != 0 {
+		t.Errorf("Expected score 0 on service without errors, got %f", score)
+	}
+}
@@ -1,5 +1,10 @@
 module github.com/gptankit/serviceq
 
-go 1.16
+go 1.23.0
 
 require golang.org/x/crypto v0.35.0
+
+require (
+	golang.org/x/net v0.25.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+)
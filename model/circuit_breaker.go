@@ -0,0 +1,22 @@
+package model
+
+import (
+	"time"
+)
+
+const (
+	CIRCUIT_CLOSED    = "closed"
+	CIRCUIT_OPEN      = "open"
+	CIRCUIT_HALF_OPEN = "half-open"
+)
+
+// CircuitBreaker is the state of the circuit to a service. An open circuit lets no request through
+// until CIRCUIT_OPEN_TIMEOUT passes, then a half-open one lets CIRCUIT_HALF_OPEN_PROBES through to
+// decide whether it closes again.
+type CircuitBreaker struct {
+	State     string
+	Failures  int       // consecutive failures while closed
+	OpenedAt  time.Time // time circuit last opened
+	Probes    int       // requests let through while half-open
+	Successes int       // probes succeeded while half-open
+}
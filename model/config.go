@@ -10,6 +10,19 @@ type Config struct {
 	EnableUpfrontQ        bool
 	EnableDeferredQ       bool
 	QRequestFormats       []string
+	QRequestRules         []RequestRule
+	QOnStatus             []StatusRule
+	UpstreamFailureStatus []StatusRule
+	LBStrategy            string
+	LBRouteStrategies     []BalancerRule
+	LBZone                string
+	ErrorHalfLife         int
+	ErrorExponent         float64
+	LatencyAlpha          float64
+	LatencyWindow         int
+	CircuitThreshold      int
+	CircuitOpenTimeout    int
+	CircuitProbes         int
 	RetryGap              int
 	OutRequestTimeout     int32
 	SSLEnabled            bool
@@ -21,4 +34,42 @@ type Config struct {
 	SSLAutoDomains        string
 	SSLAutoRenewBefore    int32
 	KeepAliveTimeout      int32
+	QBackend              string
+	QMaxAttempts          int
+	QMaxAge               int
+	QMaxItems             int
+	QMaxBytes             int64
+	QOverflow             string
+	QOverflowRetryAfter   int
+	QDrainRate            int
+	QDrainRamp            int
+	QPriorityWeights      []int
+	QPartitionBy          string
+	QCompactBy            string
+	QReplayWorkers        int
+	QReplayBackoff        int
+	QReplayBackoffMax     int
+	QReplayHeaders        bool
+	QAsyncAccept          bool
+	QAsyncStatusRoute     string
+	QAsyncResultTTL       int
+	QIdempotencyWindow    int
+	QCallbackEnabled      bool
+	QCallbackSecret       string
+	QCallbackMaxAttempts  int
+	QCallbackRetryGap     int
+	QCallbackTimeout      int32
+	QCallbackAllowedHosts []string
+	QWALDir               string
+	QWALSegmentSize       int64
+	QWALFsync             string
+	QWALFsyncInterval     int
+	QSnapshotFile         string
+	ShutdownTimeout       int
+	QStartupReplayTimeout int
+	BodySpoolThreshold    int64
+	BodySpoolDir          string
+	AdminListenerHost     string
+	AdminListenerPort     string
+	AdminToken            string
 }
@@ -5,4 +5,9 @@ type Endpoint struct {
 	Scheme       string
 	QualifiedUrl string
 	Host         string
+	Weight       int64             // share of first tries relative to other endpoints
+	Zone         string            // preferred when it matches LB_ZONE
+	Labels       map[string]string // free-form, shown on startup
+	MaxConns     int64             // requests in flight beyond which endpoint is skipped, 0 means no limit
+	Backup       bool              // used only when no primary endpoint is eligible
 }
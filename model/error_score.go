@@ -0,0 +1,11 @@
+package model
+
+import (
+	"time"
+)
+
+// ErrorScore is an exponentially decaying count of errors on a service, halved every ERROR_HALF_LIFE
+type ErrorScore struct {
+	Value     float64
+	UpdatedAt time.Time // time Value was last decayed to
+}
@@ -0,0 +1,8 @@
+package model
+
+// LatencyStats holds response times (ms) of a service
+type LatencyStats struct {
+	EWMA    float64   // exponentially weighted moving average, LATENCY_EWMA_ALPHA weighs the latest response
+	Samples []float64 // latest LATENCY_WINDOW responses, for percentiles
+	Count   uint64    // responses recorded, Samples[Count % LATENCY_WINDOW] is overwritten next
+}
@@ -5,7 +5,7 @@ import "context"
 type NetService interface {
 	Read() (interface{}, error)
 	Write(interface{}) error
-	ExecuteRealTime(context.Context, chan interface{}, chan int)
-	ExecuteBuffered(context.Context, chan interface{}, chan int)
+	ExecuteRealTime(context.Context, Queue, chan int)
+	ExecuteBuffered(context.Context, Queue)
 	Discard(context.Context)
 }
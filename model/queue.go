@@ -0,0 +1,26 @@
+package model
+
+const (
+	PRIORITY_HIGH   = "high"
+	PRIORITY_NORMAL = "normal"
+	PRIORITY_LOW    = "low"
+)
+
+// Priorities lists priority classes of buffered requests, highest first
+var Priorities = []string{PRIORITY_HIGH, PRIORITY_NORMAL, PRIORITY_LOW}
+
+// Queue stores buffered requests until they are delivered to the cluster
+type Queue interface {
+	Enqueue(RequestParam) error         // adds request to tail, assigning its Seq
+	Dequeue() (RequestParam, bool)      // takes request at head out for delivery
+	Ack(RequestParam) error             // forgets a delivered request
+	Nack(RequestParam) error            // returns an undelivered request to tail
+	Peek() (RequestParam, bool)         // returns request at head without taking it out
+	Len() int                           // number of requests not yet delivered
+	List() []RequestParam               // undelivered requests, in flight ones first and then waiting ones in order
+	Remove(uint64) (RequestParam, bool) // removes a waiting request by Seq
+	Purge() int                         // removes all waiting requests
+	Ordered(string) bool                // whether requests with given ordering key are undelivered
+	Notify() <-chan struct{}            // receives when requests may have become ready for delivery
+	Close() error
+}
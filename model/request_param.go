@@ -1,9 +1,26 @@
 package model
 
+import "time"
+
 type RequestParam struct {
-	Protocol   string
-	Method     string
-	RequestURI string
-	Headers    map[string][]string
-	BodyBuff   []byte
+	Protocol       string
+	Method         string
+	RequestURI     string
+	Headers        map[string][]string
+	BodyBuff       []byte
+	BodyFile       string    // file holding body spooled to disk instead of BodyBuff
+	BodySize       int64     // size of spooled body
+	Id             string    // serviceq request id, assigned when request is buffered
+	Seq            uint64    // queue sequence number, 0 if not queued
+	Attempts       int       // delivery attempts made so far
+	ReceivedAt     time.Time // time request was read from client
+	EnqueuedAt     time.Time // time request first entered the queue
+	CallbackURL    string    // url to post outcome to once buffered request is delivered
+	IdempotencyKey string    // client supplied key deduplicating repeated requests
+	DeliverAt      time.Time // buffered request is held until this time, if set
+	RetryAt        time.Time // buffered request is held until this time after a failed replay
+	Priority       string    // priority class of buffered request, normal if empty
+	Partition      string    // queue partition (route, host or header value), drained one at a time
+	OrderingKey    string    // buffered requests with same key are delivered strictly in order
+	CompactionKey  string    // queued request with same key is superseded by this one
 }
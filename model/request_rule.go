@@ -0,0 +1,31 @@
+package model
+
+import "regexp"
+
+// RequestRule is a parsed Q_REQUEST_FORMATS entry selecting requests for queueing
+type RequestRule struct {
+	Format   string         // entry as configured
+	Method   string         // empty matches any method
+	Path     *regexp.Regexp // matched against path without query string, nil matches any path
+	Headers  []HeaderRule   // all have to match
+	Exclude  bool           // matching requests are not queued
+	Priority string
+}
+
+// StatusRule is a parsed UPSTREAM_FAILURE_STATUS or Q_ON_STATUS entry
+type StatusRule struct {
+	Route    *RequestRule // nil applies to requests not matching any route
+	Statuses map[int]bool
+}
+
+// BalancerRule is a parsed LB_ROUTE_STRATEGY entry
+type BalancerRule struct {
+	Route    RequestRule
+	Strategy string
+}
+
+// HeaderRule is a header condition of a RequestRule
+type HeaderRule struct {
+	Name  string         // canonical header name
+	Value *regexp.Regexp // nil only requires header to be present
+}
@@ -13,11 +13,25 @@ type ServiceQProperties struct {
 	MaxConcurrency        int64
 	EnableUpfrontQ        bool
 	EnableDeferredQ       bool
-	QRequestFormats       []string
+	QRequestRules         []RequestRule // nil queues all requests
+	QOnStatus             []StatusRule  // upstream statuses making requests eligible for deferred queue
+	UpstreamFailureStatus []StatusRule  // upstream statuses counted as node failures
 	MaxRetries            int
 	RetryGap              int
-	IdleGap               int
-	RequestErrorLog       map[string]uint64
+	ErrorScores           map[string]ErrorScore // decaying error count per service
+	ErrorHalfLife         int                   // s
+	ErrorExponent         float64
+	Latencies             map[string]LatencyStats
+	LatencyAlpha          float64
+	LatencyWindow         int // responses kept per service for percentiles
+	Circuits              map[string]CircuitBreaker
+	CircuitThreshold      int // consecutive failures opening a circuit, 0 disables circuit breaking
+	CircuitOpenTimeout    int // s
+	CircuitProbes         int
+	Outstanding           map[string]int64 // requests in flight per service
+	LBStrategy            string
+	LBRouteStrategies     []BalancerRule
+	LBZone                string
 	OutRequestTimeout     int32
 	SSLEnabled            bool
 	SSLCertificateFile    string
@@ -29,5 +43,46 @@ type ServiceQProperties struct {
 	SSLAutoRenewBefore    int32
 	KeepAliveTimeout      int32
 	KeepAliveServe        bool
+	QBackend              string
+	QMaxAttempts          int    // 0 means unlimited
+	QMaxAge               int    // s, 0 means unlimited
+	QMaxItems             int    // CONCURRENCY_PEAK by default, 0 means unlimited
+	QMaxBytes             int64  // body bytes, 0 means unlimited
+	QOverflow             string // reject, drop-oldest or spill
+	QOverflowRetryAfter   int    // s
+	QDrainRate            int    // replays/s, 0 means unlimited
+	QDrainRamp            int    // s
+	QPriorityWeights      []int  // dequeue share of high, normal and low lanes
+	QPartitionBy          string // route, host or header:<name>, empty disables partitioning
+	QCompactBy            string // resource or header:<name>, empty disables compaction
+	QReplayWorkers        int
+	QReplayBackoff        int // ms
+	QReplayBackoffMax     int // ms
+	QReplayHeaders        bool
+	QAsyncAccept          bool
+	QAsyncStatusRoute     string
+	QAsyncResultTTL       int // s
+	QIdempotencyWindow    int // s, 0 disables deduplication
+	QCallbackEnabled      bool
+	QCallbackSecret       string
+	QCallbackMaxAttempts  int
+	QCallbackRetryGap     int      // s, doubled on every retry
+	QCallbackTimeout      int32    // s
+	QCallbackAllowedHosts []string // host or *.domain, empty allows any host resolving to a public address
+	QWALDir               string
+	QWALSegmentSize       int64 // MB
+	QWALFsync             string
+	QWALFsyncInterval     int    // ms
+	QSnapshotFile         string // memory backend queues are saved here on shutdown, empty disables
+	ShutdownTimeout       int    // s
+	QStartupReplayTimeout int    // s, restored requests are replayed before new connections are accepted, 0 does not wait
+	BodySpoolThreshold    int64  // bytes, 0 disables spooling
+	BodySpoolDir          string
+	AdminListenerHost     string
+	AdminListenerPort     string
+	AdminToken            string
 	REMutex               sync.Mutex
+	OSMutex               sync.Mutex
+	LTMutex               sync.Mutex
+	CBMutex               sync.Mutex
 }
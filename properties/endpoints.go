@@ -0,0 +1,104 @@
+package properties
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gptankit/serviceq/model"
+)
+
+// parseEndpoint parses an ENDPOINTS entry of the form
+//
+//	<url>[;weight=<n>][;zone=<zone>][;max_conns=<n>][;label.<name>=<value>]...[;backup]
+//
+// Endpoints weigh 1 and have no connection limit unless set. Backup endpoints only get first tries
+// once no primary endpoint is below its max connections.
+func parseEndpoint(entry string) (model.Endpoint, error) {
+
+	attrs := strings.Split(entry, ";")
+	rawUrl := attrs[0]
+	uri, err := url.ParseRequestURI(rawUrl)
+	if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") {
+		return model.Endpoint{}, errors.New("invalid url '" + rawUrl + "'")
+	}
+
+	endpoint := model.Endpoint{RawUrl: rawUrl, Scheme: uri.Scheme, Weight: 1}
+	port := ""
+	if strings.IndexByte(uri.Host, ':') == -1 || (strings.IndexByte(uri.Host, ']') != -1 && strings.Index(uri.Host, "]:") == -1) {
+		if uri.Scheme == "http" {
+			port = ":80"
+		} else if uri.Scheme == "https" {
+			port = ":443"
+		}
+	}
+	endpoint.QualifiedUrl = rawUrl + port
+	endpoint.Host = uri.Host + port
+
+	for _, attr := range attrs[1:] {
+		kv := strings.SplitN(attr, "=", 2)
+		name := kv[0]
+		if name == "backup" && len(kv) == 1 {
+			endpoint.Backup = true
+			continue
+		}
+		if len(kv) != 2 || kv[1] == "" {
+			return model.Endpoint{}, errors.New("invalid attribute '" + attr + "' of " + rawUrl)
+		}
+		value := kv[1]
+		switch {
+		case name == "weight":
+			if endpoint.Weight, err = strconv.ParseInt(value, 10, 64); err != nil || endpoint.Weight <= 0 {
+				return model.Endpoint{}, errors.New("invalid weight '" + value + "' of " + rawUrl)
+			}
+		case name == "max_conns":
+			if endpoint.MaxConns, err = strconv.ParseInt(value, 10, 64); err != nil || endpoint.MaxConns < 0 {
+				return model.Endpoint{}, errors.New("invalid max_conns '" + value + "' of " + rawUrl)
+			}
+		case name == "zone":
+			endpoint.Zone = value
+		case strings.HasPrefix(name, "label.") && len(name) > len("label."):
+			if endpoint.Labels == nil {
+				endpoint.Labels = make(map[string]string)
+			}
+			endpoint.Labels[strings.TrimPrefix(name, "label.")] = value
+		default:
+			return model.Endpoint{}, errors.New("unknown attribute '" + attr + "' of " + rawUrl)
+		}
+	}
+
+	return endpoint, nil
+}
+
+// describeEndpoint returns configured attributes of endpoint for startup output
+func describeEndpoint(endpoint model.Endpoint) string {
+
+	var attrs []string
+	if endpoint.Weight != 1 {
+		attrs = append(attrs, "weight="+strconv.FormatInt(endpoint.Weight, 10))
+	}
+	if endpoint.Zone != "" {
+		attrs = append(attrs, "zone="+endpoint.Zone)
+	}
+	if endpoint.MaxConns > 0 {
+		attrs = append(attrs, "max_conns="+strconv.FormatInt(endpoint.MaxConns, 10))
+	}
+	names := make([]string, 0, len(endpoint.Labels))
+	for name := range endpoint.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attrs = append(attrs, "label."+name+"="+endpoint.Labels[name])
+	}
+	if endpoint.Backup {
+		attrs = append(attrs, "backup")
+	}
+	if len(attrs) == 0 {
+		return ""
+	}
+
+	return " (" + strings.Join(attrs, ", ") + ")"
+}
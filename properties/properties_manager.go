@@ -3,12 +3,13 @@ package properties
 import (
 	"bufio"
 	"fmt"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/gptankit/serviceq/algorithm"
 	"github.com/gptankit/serviceq/model"
+	"github.com/gptankit/serviceq/wal"
 )
 
 const (
@@ -21,6 +22,18 @@ const (
 	SQP_K_ENABLE_UPFRONT_Q         = "ENABLE_UPFRONT_Q"
 	SQP_K_ENABLE_DEFERRED_Q        = "ENABLE_DEFERRED_Q"
 	SQP_K_Q_REQUEST_FORMATS        = "Q_REQUEST_FORMATS"
+	SQP_K_Q_ON_STATUS              = "Q_ON_STATUS"
+	SQP_K_UPSTREAM_FAILURE_STATUS  = "UPSTREAM_FAILURE_STATUS"
+	SQP_K_LB_STRATEGY              = "LB_STRATEGY"
+	SQP_K_LB_ROUTE_STRATEGY        = "LB_ROUTE_STRATEGY"
+	SQP_K_LB_ZONE                  = "LB_ZONE"
+	SQP_K_ERROR_HALF_LIFE          = "ERROR_HALF_LIFE"
+	SQP_K_ERROR_EXPONENT           = "ERROR_EXPONENT"
+	SQP_K_LATENCY_EWMA_ALPHA       = "LATENCY_EWMA_ALPHA"
+	SQP_K_LATENCY_WINDOW           = "LATENCY_WINDOW"
+	SQP_K_CIRCUIT_THRESHOLD        = "CIRCUIT_FAILURE_THRESHOLD"
+	SQP_K_CIRCUIT_OPEN_TIMEOUT     = "CIRCUIT_OPEN_TIMEOUT"
+	SQP_K_CIRCUIT_PROBES           = "CIRCUIT_HALF_OPEN_PROBES"
 	SQP_K_RETRY_GAP                = "RETRY_GAP"
 	SQP_K_OUT_REQUEST_TIMEOUT      = "OUTGOING_REQUEST_TIMEOUT"
 	SQP_K_SSL_ENABLED              = "SSL_ENABLE"
@@ -32,6 +45,44 @@ const (
 	SQP_K_SSL_AUTO_DOMAINS         = "SSL_AUTO_DOMAIN_NAMES"
 	SQP_K_SSL_AUTO_RENEW_BEFORE    = "SSL_AUTO_RENEW_BEFORE"
 	SQP_K_KEEP_ALIVE_TIMEOUT       = "KEEP_ALIVE_TIMEOUT"
+	SQP_K_Q_BACKEND                = "Q_BACKEND"
+	SQP_K_Q_MAX_ATTEMPTS           = "Q_MAX_ATTEMPTS"
+	SQP_K_Q_MAX_AGE                = "Q_MAX_AGE"
+	SQP_K_Q_MAX_ITEMS              = "Q_MAX_ITEMS"
+	SQP_K_Q_MAX_BYTES              = "Q_MAX_BYTES"
+	SQP_K_Q_OVERFLOW               = "Q_OVERFLOW"
+	SQP_K_Q_OVERFLOW_RETRY_AFTER   = "Q_OVERFLOW_RETRY_AFTER"
+	SQP_K_Q_DRAIN_RATE             = "Q_DRAIN_RATE"
+	SQP_K_Q_DRAIN_RAMP             = "Q_DRAIN_RAMP"
+	SQP_K_Q_PRIORITY_WEIGHTS       = "Q_PRIORITY_WEIGHTS"
+	SQP_K_Q_PARTITION_BY           = "Q_PARTITION_BY"
+	SQP_K_Q_COMPACT_BY             = "Q_COMPACT_BY"
+	SQP_K_Q_REPLAY_WORKERS         = "Q_REPLAY_WORKERS"
+	SQP_K_Q_REPLAY_BACKOFF         = "Q_REPLAY_BACKOFF"
+	SQP_K_Q_REPLAY_BACKOFF_MAX     = "Q_REPLAY_BACKOFF_MAX"
+	SQP_K_Q_REPLAY_HEADERS         = "Q_REPLAY_HEADERS"
+	SQP_K_Q_ASYNC_ACCEPT           = "Q_ASYNC_ACCEPT"
+	SQP_K_Q_ASYNC_STATUS_ROUTE     = "Q_ASYNC_STATUS_ROUTE"
+	SQP_K_Q_ASYNC_RESULT_TTL       = "Q_ASYNC_RESULT_TTL"
+	SQP_K_Q_IDEMPOTENCY_WINDOW     = "Q_IDEMPOTENCY_WINDOW"
+	SQP_K_Q_CALLBACK_ENABLED       = "Q_CALLBACK_ENABLE"
+	SQP_K_Q_CALLBACK_SECRET        = "Q_CALLBACK_SECRET"
+	SQP_K_Q_CALLBACK_MAX_ATTEMPTS  = "Q_CALLBACK_MAX_ATTEMPTS"
+	SQP_K_Q_CALLBACK_RETRY_GAP     = "Q_CALLBACK_RETRY_GAP"
+	SQP_K_Q_CALLBACK_TIMEOUT       = "Q_CALLBACK_TIMEOUT"
+	SQP_K_Q_CALLBACK_ALLOWED_HOSTS = "Q_CALLBACK_ALLOWED_HOSTS"
+	SQP_K_ADMIN_LISTENER_HOST      = "ADMIN_LISTENER_HOST"
+	SQP_K_ADMIN_LISTENER_PORT      = "ADMIN_LISTENER_PORT"
+	SQP_K_ADMIN_TOKEN              = "ADMIN_TOKEN"
+	SQP_K_Q_WAL_DIR                = "Q_WAL_DIR"
+	SQP_K_Q_WAL_SEGMENT_SIZE       = "Q_WAL_SEGMENT_SIZE"
+	SQP_K_Q_WAL_FSYNC              = "Q_WAL_FSYNC"
+	SQP_K_Q_WAL_FSYNC_INTERVAL     = "Q_WAL_FSYNC_INTERVAL"
+	SQP_K_Q_SNAPSHOT_FILE          = "Q_SNAPSHOT_FILE"
+	SQP_K_SHUTDOWN_TIMEOUT         = "SHUTDOWN_TIMEOUT"
+	SQP_K_Q_STARTUP_REPLAY_TIMEOUT = "Q_STARTUP_REPLAY_TIMEOUT"
+	SQP_K_BODY_SPOOL_THRESHOLD     = "BODY_SPOOL_THRESHOLD"
+	SQP_K_BODY_SPOOL_DIR           = "BODY_SPOOL_DIR"
 
 	SQ_WD  = "/usr/local/serviceq"
 	SQ_VER = "serviceq/0.4"
@@ -52,6 +103,8 @@ func New(filePath string) (*model.ServiceQProperties, error) {
 		sqp = new(model.ServiceQProperties)
 	)
 
+	setDefaults(cfg)
+
 	if fileStat, err := os.Stat(filePath); err == nil {
 		confFileSize = int(fileStat.Size())
 	} else {
@@ -66,7 +119,7 @@ func New(filePath string) (*model.ServiceQProperties, error) {
 			for {
 				if line, _, err := reader.ReadLine(); err == nil {
 					sline := string(line)
-					kvpart := strings.Split(sline, "=")
+					kvpart := strings.SplitN(sline, "=", 2) // values may contain '=' (e.g. header conditions)
 					if len(kvpart) > 0 {
 						cfg = populate(cfg, kvpart)
 					}
@@ -81,10 +134,63 @@ func New(filePath string) (*model.ServiceQProperties, error) {
 		}
 	}
 
+	setDerivedDefaults(cfg)
 	validate(cfg)
 	return getAssignedProperties(cfg), nil
 }
 
+// setDefaults assigns default values to optional config fields.
+func setDefaults(cfg *model.Config) {
+
+	cfg.LBStrategy = algorithm.STRATEGY_ERROR_WEIGHTED
+	cfg.ErrorHalfLife = 30
+	cfg.ErrorExponent = 1.5
+	cfg.LatencyAlpha = 0.3
+	cfg.LatencyWindow = 100
+	cfg.CircuitOpenTimeout = 30
+	cfg.CircuitProbes = 1
+	cfg.QBackend = "memory"
+	cfg.QMaxItems = -1 // CONCURRENCY_PEAK unless set, see setDerivedDefaults
+	cfg.QOverflow = "reject"
+	cfg.QOverflowRetryAfter = 30
+	cfg.QPriorityWeights = []int{6, 3, 1}
+	cfg.QReplayBackoff = 500
+	cfg.QReplayBackoffMax = 30000
+	cfg.QReplayHeaders = true
+	cfg.QAsyncStatusRoute = "/serviceq/requests"
+	cfg.QAsyncResultTTL = 3600
+	cfg.QCallbackMaxAttempts = 5
+	cfg.QCallbackRetryGap = 1
+	cfg.QCallbackTimeout = 5
+	cfg.AdminListenerHost = "127.0.0.1"
+	cfg.QWALDir = SQ_WD + "/data/wal"
+	cfg.QWALSegmentSize = 64
+	cfg.QWALFsync = "interval"
+	cfg.QWALFsyncInterval = 1000
+	cfg.QSnapshotFile = SQ_WD + "/data/queue.snapshot"
+	cfg.ShutdownTimeout = 30
+	cfg.QStartupReplayTimeout = 60
+	cfg.BodySpoolDir = SQ_WD + "/data/spool"
+}
+
+// setDerivedDefaults assigns default values to optional config fields depending on other fields.
+func setDerivedDefaults(cfg *model.Config) {
+
+	// queue holds as many requests as there may be connections, as it did before it could be bounded
+	if cfg.QMaxItems == -1 {
+		cfg.QMaxItems = int(cfg.ConcurrencyPeak)
+	}
+
+	// partitions are drained in parallel unless told otherwise
+	if cfg.QReplayWorkers == 0 {
+		if cfg.QPartitionBy != "" {
+			cfg.QReplayWorkers = 4
+		} else {
+			cfg.QReplayWorkers = 1
+		}
+	}
+}
+
 // populate maps key/value pairs in sq.properties to corresponding config fields.
 func populate(cfg *model.Config, kvpart []string) *model.Config {
 
@@ -97,27 +203,35 @@ func populate(cfg *model.Config, kvpart []string) *model.Config {
 	case SQP_K_ENDPOINTS:
 		vpart := strings.Split(kvpart[1], ",")
 		for _, s := range vpart {
-			uri, err := url.ParseRequestURI(s)
-			if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") {
-				fmt.Fprintf(os.Stderr, "Invalid endpoint.. exiting\n")
+			endpoint, err := parseEndpoint(s)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid endpoint, %s.. exiting\n", err.Error())
 				os.Exit(1)
 			}
-			var endpoint model.Endpoint
-			port := ""
-			endpoint.RawUrl = s
-			endpoint.Scheme = uri.Scheme
-			if strings.IndexByte(uri.Host, ':') == -1 || (strings.IndexByte(uri.Host, ']') != -1 && strings.Index(uri.Host, "]:") == -1) {
-				if uri.Scheme == "http" {
-					port = ":80"
-				} else if uri.Scheme == "https" {
-					port = ":443"
-				}
-			}
-			endpoint.QualifiedUrl = s + port
-			endpoint.Host = uri.Host + port
 			cfg.Endpoints = append(cfg.Endpoints, endpoint)
-			fmt.Printf("service addr> %s\n", endpoint.QualifiedUrl)
+			fmt.Printf("service addr> %s%s\n", endpoint.QualifiedUrl, describeEndpoint(endpoint))
 		}
+	case SQP_K_LB_ZONE:
+		cfg.LBZone = kvpart[1]
+	case SQP_K_ERROR_HALF_LIFE:
+		halfLifeVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.ErrorHalfLife = int(halfLifeVal)
+	case SQP_K_ERROR_EXPONENT:
+		cfg.ErrorExponent, _ = strconv.ParseFloat(kvpart[1], 64)
+	case SQP_K_LATENCY_EWMA_ALPHA:
+		cfg.LatencyAlpha, _ = strconv.ParseFloat(kvpart[1], 64)
+	case SQP_K_LATENCY_WINDOW:
+		latencyWindowVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.LatencyWindow = int(latencyWindowVal)
+	case SQP_K_CIRCUIT_THRESHOLD:
+		circuitThresholdVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.CircuitThreshold = int(circuitThresholdVal)
+	case SQP_K_CIRCUIT_OPEN_TIMEOUT:
+		circuitOpenTimeoutVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.CircuitOpenTimeout = int(circuitOpenTimeoutVal)
+	case SQP_K_CIRCUIT_PROBES:
+		circuitProbesVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.CircuitProbes = int(circuitProbesVal)
 	case SQP_K_MAX_CONCURRENT_CONNS:
 		cfg.ConcurrencyPeak, _ = strconv.ParseInt(kvpart[1], 10, 64)
 		fmt.Printf("concurreny peak> %d\n", cfg.ConcurrencyPeak)
@@ -126,7 +240,34 @@ func populate(cfg *model.Config, kvpart []string) *model.Config {
 	case SQP_K_ENABLE_DEFERRED_Q:
 		cfg.EnableDeferredQ, _ = strconv.ParseBool(kvpart[1])
 	case SQP_K_Q_REQUEST_FORMATS:
-		cfg.QRequestFormats = strings.Split(kvpart[1], ",")
+		cfg.QRequestFormats = splitRules(kvpart[1], ',')
+		rules, err := parseRequestRules(cfg.QRequestFormats)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid Q_REQUEST_FORMATS, %s.. exiting\n", err.Error())
+			os.Exit(1)
+		}
+		cfg.QRequestRules = rules
+	case SQP_K_LB_STRATEGY:
+		cfg.LBStrategy = kvpart[1]
+		fmt.Printf("lb strategy> %s\n", cfg.LBStrategy)
+	case SQP_K_LB_ROUTE_STRATEGY:
+		rules, err := parseBalancerRules(kvpart[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid LB_ROUTE_STRATEGY, %s.. exiting\n", err.Error())
+			os.Exit(1)
+		}
+		cfg.LBRouteStrategies = rules
+	case SQP_K_Q_ON_STATUS, SQP_K_UPSTREAM_FAILURE_STATUS:
+		rules, err := parseStatusRules(kvpart[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid %s, %s.. exiting\n", kvpart[0], err.Error())
+			os.Exit(1)
+		}
+		if kvpart[0] == SQP_K_Q_ON_STATUS {
+			cfg.QOnStatus = rules
+		} else {
+			cfg.UpstreamFailureStatus = rules
+		}
 	case SQP_K_RETRY_GAP:
 		retryGapVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
 		cfg.RetryGap = int(retryGapVal)
@@ -165,6 +306,110 @@ func populate(cfg *model.Config, kvpart []string) *model.Config {
 	case SQP_K_KEEP_ALIVE_TIMEOUT:
 		keepAliveTimeout, _ := strconv.ParseInt(kvpart[1], 10, 32)
 		cfg.KeepAliveTimeout = int32(keepAliveTimeout)
+	case SQP_K_Q_BACKEND:
+		cfg.QBackend = kvpart[1]
+		fmt.Printf("queue backend> %s\n", cfg.QBackend)
+	case SQP_K_Q_MAX_ATTEMPTS:
+		maxAttemptsVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QMaxAttempts = int(maxAttemptsVal)
+	case SQP_K_Q_MAX_AGE:
+		maxAgeVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QMaxAge = int(maxAgeVal)
+	case SQP_K_Q_MAX_ITEMS:
+		maxItemsVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QMaxItems = int(maxItemsVal)
+	case SQP_K_Q_MAX_BYTES:
+		cfg.QMaxBytes, _ = strconv.ParseInt(kvpart[1], 10, 64)
+	case SQP_K_Q_OVERFLOW:
+		cfg.QOverflow = kvpart[1]
+	case SQP_K_Q_OVERFLOW_RETRY_AFTER:
+		retryAfterVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QOverflowRetryAfter = int(retryAfterVal)
+	case SQP_K_Q_DRAIN_RATE:
+		drainRateVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QDrainRate = int(drainRateVal)
+	case SQP_K_Q_DRAIN_RAMP:
+		drainRampVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QDrainRamp = int(drainRampVal)
+	case SQP_K_Q_PRIORITY_WEIGHTS:
+		vpart := strings.Split(kvpart[1], ",")
+		cfg.QPriorityWeights = make([]int, 0, len(vpart))
+		for _, s := range vpart {
+			weightVal, _ := strconv.ParseInt(s, 10, 32)
+			cfg.QPriorityWeights = append(cfg.QPriorityWeights, int(weightVal))
+		}
+	case SQP_K_Q_PARTITION_BY:
+		cfg.QPartitionBy = kvpart[1]
+	case SQP_K_Q_COMPACT_BY:
+		cfg.QCompactBy = kvpart[1]
+	case SQP_K_Q_REPLAY_WORKERS:
+		replayWorkersVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QReplayWorkers = int(replayWorkersVal)
+	case SQP_K_Q_REPLAY_BACKOFF:
+		replayBackoffVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QReplayBackoff = int(replayBackoffVal)
+	case SQP_K_Q_REPLAY_BACKOFF_MAX:
+		replayBackoffMaxVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QReplayBackoffMax = int(replayBackoffMaxVal)
+	case SQP_K_Q_REPLAY_HEADERS:
+		cfg.QReplayHeaders, _ = strconv.ParseBool(kvpart[1])
+	case SQP_K_Q_ASYNC_ACCEPT:
+		cfg.QAsyncAccept, _ = strconv.ParseBool(kvpart[1])
+	case SQP_K_Q_ASYNC_STATUS_ROUTE:
+		cfg.QAsyncStatusRoute = strings.TrimSuffix(kvpart[1], "/")
+	case SQP_K_Q_ASYNC_RESULT_TTL:
+		resultTTLVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QAsyncResultTTL = int(resultTTLVal)
+	case SQP_K_Q_IDEMPOTENCY_WINDOW:
+		idempotencyWindowVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QIdempotencyWindow = int(idempotencyWindowVal)
+	case SQP_K_Q_CALLBACK_ENABLED:
+		cfg.QCallbackEnabled, _ = strconv.ParseBool(kvpart[1])
+	case SQP_K_Q_CALLBACK_SECRET:
+		cfg.QCallbackSecret = kvpart[1]
+	case SQP_K_Q_CALLBACK_MAX_ATTEMPTS:
+		callbackMaxAttemptsVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QCallbackMaxAttempts = int(callbackMaxAttemptsVal)
+	case SQP_K_Q_CALLBACK_RETRY_GAP:
+		callbackRetryGapVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QCallbackRetryGap = int(callbackRetryGapVal)
+	case SQP_K_Q_CALLBACK_TIMEOUT:
+		callbackTimeoutVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QCallbackTimeout = int32(callbackTimeoutVal)
+	case SQP_K_Q_CALLBACK_ALLOWED_HOSTS:
+		for _, host := range strings.Split(kvpart[1], ",") {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				cfg.QCallbackAllowedHosts = append(cfg.QCallbackAllowedHosts, host)
+			}
+		}
+	case SQP_K_ADMIN_LISTENER_HOST:
+		cfg.AdminListenerHost = kvpart[1]
+	case SQP_K_ADMIN_LISTENER_PORT:
+		cfg.AdminListenerPort = kvpart[1]
+		fmt.Printf("admin listening on port> %s\n", cfg.AdminListenerPort)
+	case SQP_K_ADMIN_TOKEN:
+		cfg.AdminToken = kvpart[1]
+	case SQP_K_Q_WAL_DIR:
+		cfg.QWALDir = kvpart[1]
+	case SQP_K_Q_WAL_SEGMENT_SIZE:
+		cfg.QWALSegmentSize, _ = strconv.ParseInt(kvpart[1], 10, 64)
+	case SQP_K_Q_WAL_FSYNC:
+		cfg.QWALFsync = kvpart[1]
+	case SQP_K_Q_WAL_FSYNC_INTERVAL:
+		fsyncIntervalVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QWALFsyncInterval = int(fsyncIntervalVal)
+	case SQP_K_Q_SNAPSHOT_FILE:
+		cfg.QSnapshotFile = kvpart[1]
+	case SQP_K_SHUTDOWN_TIMEOUT:
+		shutdownTimeoutVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.ShutdownTimeout = int(shutdownTimeoutVal)
+	case SQP_K_Q_STARTUP_REPLAY_TIMEOUT:
+		startupReplayTimeoutVal, _ := strconv.ParseInt(kvpart[1], 10, 32)
+		cfg.QStartupReplayTimeout = int(startupReplayTimeoutVal)
+	case SQP_K_BODY_SPOOL_THRESHOLD:
+		cfg.BodySpoolThreshold, _ = strconv.ParseInt(kvpart[1], 10, 64)
+	case SQP_K_BODY_SPOOL_DIR:
+		cfg.BodySpoolDir = kvpart[1]
 	default:
 		break
 	}
@@ -179,6 +424,95 @@ func validate(cfg *model.Config) {
 		fmt.Fprintf(os.Stderr, "Something wrong with sq.properties... exiting\n")
 		os.Exit(1)
 	}
+
+	if cfg.QAsyncAccept && (!strings.HasPrefix(cfg.QAsyncStatusRoute, "/") || cfg.QAsyncResultTTL <= 0) {
+		fmt.Fprintf(os.Stderr, "Invalid async accept settings in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if validOverflow := cfg.QOverflow == "reject" || cfg.QOverflow == "drop-oldest" || cfg.QOverflow == "spill"; !validOverflow ||
+		cfg.QMaxItems < 0 || cfg.QMaxBytes < 0 || cfg.QOverflowRetryAfter < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid queue limit settings in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if cfg.QReplayWorkers <= 0 || cfg.QReplayBackoff < 0 || cfg.QReplayBackoffMax < cfg.QReplayBackoff {
+		fmt.Fprintf(os.Stderr, "Invalid queue replay settings in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if cfg.ShutdownTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid shutdown timeout in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if cfg.QStartupReplayTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid startup replay timeout in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if cfg.BodySpoolThreshold < 0 || (cfg.BodySpoolThreshold > 0 && cfg.BodySpoolDir == "") {
+		fmt.Fprintf(os.Stderr, "Invalid body spool settings in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if cfg.QDrainRate < 0 || cfg.QDrainRamp < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid queue drain settings in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if len(cfg.QPriorityWeights) != len(model.Priorities) {
+		fmt.Fprintf(os.Stderr, "Invalid queue priority weights in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+	for _, weight := range cfg.QPriorityWeights {
+		if weight <= 0 {
+			fmt.Fprintf(os.Stderr, "Invalid queue priority weights in sq.properties... exiting\n")
+			os.Exit(1)
+		}
+	}
+
+	if validBy := cfg.QPartitionBy == "" || cfg.QPartitionBy == "route" || cfg.QPartitionBy == "host" ||
+		(strings.HasPrefix(cfg.QPartitionBy, "header:") && len(cfg.QPartitionBy) > len("header:")); !validBy {
+		fmt.Fprintf(os.Stderr, "Invalid queue partition settings in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if validBy := cfg.QCompactBy == "" || cfg.QCompactBy == "resource" ||
+		(strings.HasPrefix(cfg.QCompactBy, "header:") && len(cfg.QCompactBy) > len("header:")); !validBy {
+		fmt.Fprintf(os.Stderr, "Invalid queue compaction settings in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if cfg.ErrorHalfLife <= 0 || cfg.ErrorExponent < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid error score settings in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if cfg.LatencyAlpha <= 0 || cfg.LatencyAlpha > 1 || cfg.LatencyWindow <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid latency settings in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if cfg.CircuitThreshold < 0 || (cfg.CircuitThreshold > 0 && (cfg.CircuitOpenTimeout <= 0 || cfg.CircuitProbes <= 0)) {
+		fmt.Fprintf(os.Stderr, "Invalid circuit breaker settings in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if _, ok := algorithm.GetBalancer(cfg.LBStrategy); !ok {
+		fmt.Fprintf(os.Stderr, "Invalid lb strategy in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if cfg.QBackend != "memory" && cfg.QBackend != "file" {
+		fmt.Fprintf(os.Stderr, "Invalid queue backend in sq.properties... exiting\n")
+		os.Exit(1)
+	}
+
+	if _, err := wal.ParseFsyncPolicy(cfg.QWALFsync); cfg.QBackend == "file" && (err != nil || cfg.QWALDir == "" || cfg.QWALSegmentSize <= 0) {
+		fmt.Fprintf(os.Stderr, "Invalid queue wal settings in sq.properties... exiting\n")
+		os.Exit(1)
+	}
 }
 
 // getAssignedProperties returns a new ServiceQProperties object
@@ -194,11 +528,32 @@ func getAssignedProperties(cfg *model.Config) *model.ServiceQProperties {
 		MaxConcurrency:        cfg.ConcurrencyPeak,
 		EnableUpfrontQ:        cfg.EnableUpfrontQ,
 		EnableDeferredQ:       cfg.EnableDeferredQ,
-		QRequestFormats:       cfg.QRequestFormats,
+		QRequestRules:         cfg.QRequestRules,
+		QOnStatus:             cfg.QOnStatus,
+		UpstreamFailureStatus: cfg.UpstreamFailureStatus,
+		QPriorityWeights:      cfg.QPriorityWeights,
+		QPartitionBy:          cfg.QPartitionBy,
+		QCompactBy:            cfg.QCompactBy,
+		QReplayWorkers:        cfg.QReplayWorkers,
+		QReplayBackoff:        cfg.QReplayBackoff,
+		QReplayBackoffMax:     cfg.QReplayBackoffMax,
+		QReplayHeaders:        cfg.QReplayHeaders,
 		MaxRetries:            len(cfg.Endpoints),
 		RetryGap:              cfg.RetryGap,
-		IdleGap:               500,
-		RequestErrorLog:       make(map[string]uint64, len(cfg.Endpoints)),
+		ErrorScores:           make(map[string]model.ErrorScore, len(cfg.Endpoints)),
+		ErrorHalfLife:         cfg.ErrorHalfLife,
+		ErrorExponent:         cfg.ErrorExponent,
+		Latencies:             make(map[string]model.LatencyStats, len(cfg.Endpoints)),
+		LatencyAlpha:          cfg.LatencyAlpha,
+		LatencyWindow:         cfg.LatencyWindow,
+		Circuits:              make(map[string]model.CircuitBreaker, len(cfg.Endpoints)),
+		CircuitThreshold:      cfg.CircuitThreshold,
+		CircuitOpenTimeout:    cfg.CircuitOpenTimeout,
+		CircuitProbes:         cfg.CircuitProbes,
+		Outstanding:           make(map[string]int64, len(cfg.Endpoints)),
+		LBStrategy:            cfg.LBStrategy,
+		LBRouteStrategies:     cfg.LBRouteStrategies,
+		LBZone:                cfg.LBZone,
 		OutRequestTimeout:     cfg.OutRequestTimeout,
 		SSLEnabled:            cfg.SSLEnabled,
 		SSLCertificateFile:    cfg.SSLCertificateFile,
@@ -210,6 +565,37 @@ func getAssignedProperties(cfg *model.Config) *model.ServiceQProperties {
 		SSLAutoRenewBefore:    cfg.SSLAutoRenewBefore,
 		KeepAliveTimeout:      cfg.KeepAliveTimeout,
 		KeepAliveServe:        keepAliveServe(cfg.CustomResponseHeaders),
+		QBackend:              cfg.QBackend,
+		QMaxAttempts:          cfg.QMaxAttempts,
+		QMaxAge:               cfg.QMaxAge,
+		QMaxItems:             cfg.QMaxItems,
+		QMaxBytes:             cfg.QMaxBytes,
+		QOverflow:             cfg.QOverflow,
+		QOverflowRetryAfter:   cfg.QOverflowRetryAfter,
+		QDrainRate:            cfg.QDrainRate,
+		QDrainRamp:            cfg.QDrainRamp,
+		QAsyncAccept:          cfg.QAsyncAccept,
+		QAsyncStatusRoute:     cfg.QAsyncStatusRoute,
+		QAsyncResultTTL:       cfg.QAsyncResultTTL,
+		QIdempotencyWindow:    cfg.QIdempotencyWindow,
+		QCallbackEnabled:      cfg.QCallbackEnabled,
+		QCallbackSecret:       cfg.QCallbackSecret,
+		QCallbackMaxAttempts:  cfg.QCallbackMaxAttempts,
+		QCallbackRetryGap:     cfg.QCallbackRetryGap,
+		QCallbackTimeout:      cfg.QCallbackTimeout,
+		QCallbackAllowedHosts: cfg.QCallbackAllowedHosts,
+		AdminListenerHost:     cfg.AdminListenerHost,
+		AdminListenerPort:     cfg.AdminListenerPort,
+		AdminToken:            cfg.AdminToken,
+		QWALDir:               cfg.QWALDir,
+		QWALSegmentSize:       cfg.QWALSegmentSize,
+		QWALFsync:             cfg.QWALFsync,
+		QWALFsyncInterval:     cfg.QWALFsyncInterval,
+		QSnapshotFile:         cfg.QSnapshotFile,
+		ShutdownTimeout:       cfg.ShutdownTimeout,
+		QStartupReplayTimeout: cfg.QStartupReplayTimeout,
+		BodySpoolThreshold:    cfg.BodySpoolThreshold,
+		BodySpoolDir:          cfg.BodySpoolDir,
 	}
 }
 
@@ -41,3 +41,140 @@ func TestMandatoryProperties(t *testing.T) {
 		}
 	}
 }
+
+func TestRequestRules(t *testing.T) {
+
+	rules, err := parseRequestRules([]string{"POST /orders/**:high", "PUT /items/{id}", "GET ~^/reports/[0-9]+$", "DELETE /carts/*/items ! ", "ALL Content-Type=application/json X-Tenant~^acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rules[0].Method != "POST" || rules[0].Priority != model.PRIORITY_HIGH || !rules[0].Path.MatchString("/orders/1/lines") || rules[0].Path.MatchString("/order") {
+		t.Errorf("Prefix rule not parsed as expected")
+	}
+	if !rules[1].Path.MatchString("/items/42") || rules[1].Path.MatchString("/items/42/tags") {
+		t.Errorf("Path param rule not parsed as expected")
+	}
+	if !rules[2].Path.MatchString("/reports/7") || rules[2].Path.MatchString("/reports/x") {
+		t.Errorf("Regex rule not parsed as expected")
+	}
+	if !rules[3].Exclude || !rules[3].Path.MatchString("/carts/9/items") {
+		t.Errorf("Exclusion rule not parsed as expected")
+	}
+	if rules[4].Method != "" || rules[4].Path != nil || len(rules[4].Headers) != 2 || rules[4].Headers[1].Name != "X-Tenant" || !rules[4].Headers[1].Value.MatchString("acme-eu") {
+		t.Errorf("Header rule not parsed as expected")
+	}
+
+	if _, err := parseRequestRules([]string{"POST /orders/{id"}); err == nil {
+		t.Errorf("Expected error on unclosed path param")
+	}
+}
+
+func TestSplitRules(t *testing.T) {
+
+	formats := splitRules(`POST ~^/orders/[0-9]{2,4}$,PUT /items/{id},GET ~^/(a|b)/[,]+$,DELETE ~^/x\,y$`, ',')
+	if len(formats) != 4 || formats[0] != "POST ~^/orders/[0-9]{2,4}$" || formats[2] != "GET ~^/(a|b)/[,]+$" {
+		t.Fatalf("Request formats not split as expected, got %q", formats)
+	}
+
+	rules, err := parseRequestRules(formats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rules[0].Path.MatchString("/orders/123") || rules[0].Path.MatchString("/orders/12345") {
+		t.Errorf("Quantifier rule not parsed as expected")
+	}
+
+	statusRules, err := parseStatusRules("503|GET ~^/(a|b)$=502")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statusRules) != 2 || !statusRules[1].Route.Path.MatchString("/b") {
+		t.Errorf("Alternation in status rule not parsed as expected")
+	}
+}
+
+func TestStatusRules(t *testing.T) {
+
+	rules, err := parseStatusRules("502,503|POST /payments/** X-Retry=*=5xx,429")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 2 || rules[0].Route != nil || !rules[0].Statuses[503] || rules[0].Statuses[500] {
+		t.Errorf("Default status rule not parsed as expected")
+	}
+	if rules[1].Route == nil || rules[1].Route.Method != "POST" || len(rules[1].Route.Headers) != 1 || !rules[1].Statuses[500] || !rules[1].Statuses[429] || rules[1].Statuses[404] {
+		t.Errorf("Route status rule not parsed as expected")
+	}
+
+	if _, err := parseStatusRules("50x"); err == nil {
+		t.Errorf("Expected error on invalid status")
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+
+	endpoint, err := parseEndpoint("http://my.server1.com;weight=2;zone=eu-1;max_conns=100;label.tier=gold;backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint.RawUrl != "http://my.server1.com" || endpoint.QualifiedUrl != "http://my.server1.com:80" || endpoint.Host != "my.server1.com:80" {
+		t.Errorf("Endpoint url not parsed as expected, got %+v", endpoint)
+	}
+	if endpoint.Weight != 2 || endpoint.Zone != "eu-1" || endpoint.MaxConns != 100 || endpoint.Labels["tier"] != "gold" || !endpoint.Backup {
+		t.Errorf("Endpoint attributes not parsed as expected, got %+v", endpoint)
+	}
+
+	if endpoint, _ := parseEndpoint("https://my.server2.com:8443"); endpoint.Weight != 1 || endpoint.Backup || endpoint.QualifiedUrl != "https://my.server2.com:8443" {
+		t.Errorf("Endpoint defaults not set as expected, got %+v", endpoint)
+	}
+
+	for _, entry := range []string{"ftp://my.server1.com", "http://my.server1.com;weight=0", "http://my.server1.com;max_conns=x", "http://my.server1.com;color=red"} {
+		if _, err := parseEndpoint(entry); err == nil {
+			t.Errorf("Expected error on %s", entry)
+		}
+	}
+}
+
+func TestReplayWorkers(t *testing.T) {
+
+	cfg := new(model.Config)
+	setDefaults(cfg)
+	setDerivedDefaults(cfg)
+	if cfg.QReplayWorkers != 1 {
+		t.Errorf("Expected 1 replay worker without partitioning, got %d", cfg.QReplayWorkers)
+	}
+
+	cfg = new(model.Config)
+	setDefaults(cfg)
+	populate(cfg, []string{SQP_K_Q_PARTITION_BY, "route"})
+	setDerivedDefaults(cfg)
+	if cfg.QReplayWorkers != 4 {
+		t.Errorf("Expected 4 replay workers with partitioning, got %d", cfg.QReplayWorkers)
+	}
+
+	populate(cfg, []string{SQP_K_Q_REPLAY_WORKERS, "8"})
+	setDerivedDefaults(cfg)
+	if cfg.QReplayWorkers != 8 {
+		t.Errorf("Expected Q_REPLAY_WORKERS to set 8 replay workers, got %d", cfg.QReplayWorkers)
+	}
+}
+
+func TestQueueLimitDefault(t *testing.T) {
+
+	cfg := new(model.Config)
+	setDefaults(cfg)
+	populate(cfg, []string{SQP_K_MAX_CONCURRENT_CONNS, "2048"})
+	setDerivedDefaults(cfg)
+	if cfg.QMaxItems != 2048 {
+		t.Errorf("Expected queue bounded by CONCURRENCY_PEAK, got %d", cfg.QMaxItems)
+	}
+
+	populate(cfg, []string{SQP_K_Q_MAX_ITEMS, "0"})
+	setDerivedDefaults(cfg)
+	if cfg.QMaxItems != 0 {
+		t.Errorf("Expected Q_MAX_ITEMS=0 to lift the limit, got %d", cfg.QMaxItems)
+	}
+}
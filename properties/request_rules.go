@@ -0,0 +1,227 @@
+package properties
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gptankit/serviceq/algorithm"
+	"github.com/gptankit/serviceq/model"
+)
+
+// parseRequestRules parses Q_REQUEST_FORMATS entries of the form
+//
+//	<METHOD|ALL|*> [<path>] [<header>=<value>|<header>=*|<header>~<regex>]... [!][:high|:normal|:low]
+//
+// Path is matched without query string and is either exact (/orders), a glob where * and ? do not
+// cross '/' (/orders/*/items), a prefix (/orders/**), with path params (/orders/{id}) or a regex (~^/orders/\d+$).
+// A trailing ! excludes matching requests from queueing. Entries are matched in order, first match wins.
+func parseRequestRules(formats []string) ([]model.RequestRule, error) {
+
+	rules := make([]model.RequestRule, 0, len(formats))
+	for _, format := range formats {
+		rule, err := parseRequestRule(strings.TrimSpace(format))
+		if err != nil {
+			return nil, errors.New("invalid request format '" + format + "' -- " + err.Error())
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// parseRequestRule parses a single Q_REQUEST_FORMATS entry
+func parseRequestRule(format string) (model.RequestRule, error) {
+
+	rule := model.RequestRule{Format: format, Priority: model.PRIORITY_NORMAL}
+	if i := strings.LastIndex(format, ":"); i != -1 {
+		for _, priority := range model.Priorities {
+			if format[i+1:] == priority {
+				format, rule.Priority = format[:i], priority
+				break
+			}
+		}
+	}
+
+	tokens := strings.Fields(format)
+	if len(tokens) == 0 {
+		return rule, errors.New("empty")
+	}
+	if tokens[0] != "ALL" && tokens[0] != "*" {
+		rule.Method = strings.ToUpper(tokens[0])
+	}
+	tokens = tokens[1:]
+
+	if len(tokens) > 0 && tokens[len(tokens)-1] == "!" {
+		rule.Exclude = true
+		tokens = tokens[:len(tokens)-1]
+	}
+
+	if len(tokens) > 0 && (strings.HasPrefix(tokens[0], "/") || strings.HasPrefix(tokens[0], "~")) {
+		path, err := compilePath(tokens[0])
+		if err != nil {
+			return rule, err
+		}
+		rule.Path = path
+		tokens = tokens[1:]
+	}
+
+	for _, token := range tokens {
+		header, err := compileHeader(token)
+		if err != nil {
+			return rule, err
+		}
+		rule.Headers = append(rule.Headers, header)
+	}
+
+	return rule, nil
+}
+
+// compilePath translates a path pattern into a regex
+func compilePath(pattern string) (*regexp.Regexp, error) {
+
+	if strings.HasPrefix(pattern, "~") {
+		return regexp.Compile(pattern[1:])
+	}
+
+	prefix := strings.HasSuffix(pattern, "**")
+	pattern = strings.TrimSuffix(pattern, "**")
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expr.WriteString("[^/]*")
+		case '?':
+			expr.WriteString("[^/]")
+		case '{':
+			end := strings.IndexByte(pattern[i:], '}')
+			if end == -1 {
+				return nil, errors.New("unclosed path param")
+			}
+			expr.WriteString("[^/]+")
+			i += end
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if !prefix {
+		expr.WriteString("$")
+	}
+
+	return regexp.Compile(expr.String())
+}
+
+// compileHeader parses a header condition
+func compileHeader(token string) (model.HeaderRule, error) {
+
+	if i := strings.IndexAny(token, "=~"); i > 0 {
+		header := model.HeaderRule{Name: http.CanonicalHeaderKey(token[:i])}
+		value := token[i+1:]
+		var err error
+		switch {
+		case token[i] == '~':
+			header.Value, err = regexp.Compile(value)
+		case value != "*":
+			header.Value, err = regexp.Compile("^" + regexp.QuoteMeta(value) + "$")
+		}
+		return header, err
+	}
+
+	return model.HeaderRule{}, errors.New("invalid header condition '" + token + "'")
+}
+
+// parseStatusRules parses UPSTREAM_FAILURE_STATUS and Q_ON_STATUS values of the form
+//
+//	<statuses>|<request format>=<statuses>|...
+//
+// where statuses are comma separated codes (503) or classes (5xx). Entries with a request format
+// apply to matching requests, the first one wins. The entry without one applies to all other requests.
+func parseStatusRules(value string) ([]model.StatusRule, error) {
+
+	var rules []model.StatusRule
+	for _, entry := range splitRules(value, '|') {
+		var rule model.StatusRule
+		if i := strings.LastIndex(entry, "="); i != -1 {
+			route, err := parseRequestRule(strings.TrimSpace(entry[:i]))
+			if err != nil {
+				return nil, errors.New("invalid request format '" + entry[:i] + "' -- " + err.Error())
+			}
+			rule.Route = &route
+			entry = entry[i+1:]
+		}
+
+		rule.Statuses = make(map[int]bool)
+		for _, status := range strings.Split(entry, ",") {
+			status = strings.TrimSpace(strings.ToLower(status))
+			if len(status) == 3 && strings.HasSuffix(status, "xx") && status[0] >= '1' && status[0] <= '5' {
+				class := int(status[0]-'0') * 100
+				for code := class; code < class+100; code++ {
+					rule.Statuses[code] = true
+				}
+				continue
+			}
+			code, err := strconv.Atoi(status)
+			if err != nil || code < 100 || code > 599 {
+				return nil, errors.New("invalid status '" + status + "'")
+			}
+			rule.Statuses[code] = true
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// parseBalancerRules parses LB_ROUTE_STRATEGY values of the form <request format>=<strategy>|...
+func parseBalancerRules(value string) ([]model.BalancerRule, error) {
+
+	var rules []model.BalancerRule
+	for _, entry := range splitRules(value, '|') {
+		i := strings.LastIndex(entry, "=")
+		if i == -1 {
+			return nil, errors.New("missing strategy in '" + entry + "'")
+		}
+		route, err := parseRequestRule(strings.TrimSpace(entry[:i]))
+		if err != nil {
+			return nil, errors.New("invalid request format '" + entry[:i] + "' -- " + err.Error())
+		}
+		strategy := strings.TrimSpace(entry[i+1:])
+		if _, ok := algorithm.GetBalancer(strategy); !ok {
+			return nil, errors.New("unknown strategy '" + strategy + "'")
+		}
+		rules = append(rules, model.BalancerRule{Route: route, Strategy: strategy})
+	}
+
+	return rules, nil
+}
+
+// splitRules splits value on sep, except where sep is escaped or inside (), [] or {}, so that regexes
+// in request formats may contain quantifiers such as {2,4} and alternations such as (a|b)
+func splitRules(value string, sep byte) []string {
+
+	var parts []string
+	start, depth, inClass := 0, 0, false
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '\\':
+			i++ // skip escaped character
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c == '(' || c == '{':
+			depth++
+		case (c == ')' || c == '}') && depth > 0:
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, value[start:])
+}
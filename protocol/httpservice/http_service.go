@@ -2,24 +2,44 @@ package httpservice
 
 import (
 	"bufio"
-	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"io/ioutil"
+	mathrand "math/rand"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gptankit/serviceq/algorithm"
+	"github.com/gptankit/serviceq/callback"
 	"github.com/gptankit/serviceq/errorlog"
 	"github.com/gptankit/serviceq/model"
+	"github.com/gptankit/serviceq/queue"
+	"github.com/gptankit/serviceq/result"
+	"github.com/gptankit/serviceq/spool"
 	"github.com/gptankit/serviceq/tcputils"
 )
 
 var _ model.NetService = &HTTPService{}
 
+const (
+	HEADER_REQUEST_ID          = "X-SQ-Request-Id"
+	HEADER_QUEUE_POSITION      = "X-SQ-Queue-Position"
+	HEADER_IDEMPOTENCY_KEY     = "Idempotency-Key"
+	HEADER_IDEMPOTENT_REPLAYED = "Idempotent-Replayed"
+	HEADER_DELIVER_AT          = "X-SQ-Deliver-At"
+	HEADER_DELAY               = "X-SQ-Delay"
+	HEADER_ORDERING_KEY        = "X-SQ-Ordering-Key"
+	HEADER_RECEIVED_AT         = "X-SQ-Received-At"
+	HEADER_ATTEMPT             = "X-SQ-Attempt"
+	HEADER_QUEUE_WAIT          = "X-SQ-Queue-Wait"
+)
+
 // HTTPService is the core http flow handler
 type HTTPService struct {
 	inTCPConn     *net.Conn
@@ -27,6 +47,16 @@ type HTTPService struct {
 	inTCPWriter   *bufio.Writer
 	outHTTPClient *http.Client
 	properties    *model.ServiceQProperties
+	deadLetterQ   model.Queue
+	results       *result.Store
+	keys          *result.KeyStore
+	callbacks     *callback.Dispatcher
+	drain         *queue.DrainLimiter
+	spooler       *spool.Spooler
+	stop          context.Context
+	connMu        sync.Mutex
+	connIdle      bool
+	connStopped   bool
 }
 
 type HTTPServiceOption func(*HTTPService) error
@@ -67,6 +97,84 @@ func WithIncomingTCPConn(tcpConn *net.Conn) HTTPServiceOption {
 	}
 }
 
+// WithDeadLetterQueue assigns the store for buffered requests that exhaust their attempts or age
+func WithDeadLetterQueue(dlq model.Queue) HTTPServiceOption {
+
+	return func(httpSrv *HTTPService) error {
+
+		httpSrv.deadLetterQ = dlq
+
+		return nil
+	}
+}
+
+// WithResultStore assigns the store keeping results of buffered requests for status polling
+func WithResultStore(results *result.Store) HTTPServiceOption {
+
+	return func(httpSrv *HTTPService) error {
+
+		httpSrv.results = results
+
+		return nil
+	}
+}
+
+// WithKeyStore enables deduplication of requests carrying an Idempotency-Key header
+func WithKeyStore(keys *result.KeyStore) HTTPServiceOption {
+
+	return func(httpSrv *HTTPService) error {
+
+		httpSrv.keys = keys
+
+		return nil
+	}
+}
+
+// WithCallbackDispatcher enables delivery of buffered request outcomes to X-SQ-Callback-URL
+func WithCallbackDispatcher(callbacks *callback.Dispatcher) HTTPServiceOption {
+
+	return func(httpSrv *HTTPService) error {
+
+		httpSrv.callbacks = callbacks
+
+		return nil
+	}
+}
+
+// WithDrainLimiter paces replays of buffered requests
+func WithDrainLimiter(drain *queue.DrainLimiter) HTTPServiceOption {
+
+	return func(httpSrv *HTTPService) error {
+
+		httpSrv.drain = drain
+
+		return nil
+	}
+}
+
+// WithSpooler spools request bodies above BODY_SPOOL_THRESHOLD to disk
+func WithSpooler(spooler *spool.Spooler) HTTPServiceOption {
+
+	return func(httpSrv *HTTPService) error {
+
+		httpSrv.spooler = spooler
+
+		return nil
+	}
+}
+
+// WithShutdown winds connections and replay workers down once stop is done. Idle keep-alive
+// connections are closed, while requests in flight finish until ctx passed to Execute* is done.
+func WithShutdown(stop context.Context) HTTPServiceOption {
+
+	return func(httpSrv *HTTPService) error {
+
+		httpSrv.stop = stop
+
+		return nil
+	}
+}
+
 // NewNop returns a HTTPService that does nothing
 func NewNop(sqp *model.ServiceQProperties) *HTTPService {
 
@@ -136,20 +244,32 @@ func (httpSrv *HTTPService) Write(resp interface{}) error {
 // ExecuteRealTime reads from incoming http connection and attempts to forward it to upstream nodes by calling
 // dialAndSend(). It temporarily saves the request before forwarding, if needed for subsequent retries. This saved
 // request can be buffered if dialAndSend() is unable to forward to any upstream nodes.
-func (httpSrv *HTTPService) ExecuteRealTime(ctx context.Context, creq chan interface{}, cwork chan int) {
+func (httpSrv *HTTPService) ExecuteRealTime(ctx context.Context, q model.Queue, cwork chan int) {
 
 	tcputils.SetTCPDeadline(httpSrv.inTCPConn, httpSrv.properties.KeepAliveTimeout)
 
+	stop, done := httpSrv.shutdown(ctx), make(chan struct{})
+	defer close(done)
+	go httpSrv.closeIdle(stop, done)
+
 	for {
 
 		var resParam model.ResponseParam
 		var reqParam model.RequestParam
 		var toBuffer bool
 
+		// no more requests on conn once shutting down
+		if !httpSrv.setIdle(true) {
+			httpSrv.forceCloseConn()
+			break
+		}
+
 		// read from and write to conn
 		reqp, err := httpSrv.Read()
+		httpSrv.setIdle(false)
 		req, ok := reqp.(*http.Request)
 		if !ok {
+			httpSrv.forceCloseConn()
 			break
 		}
 
@@ -157,30 +277,75 @@ func (httpSrv *HTTPService) ExecuteRealTime(ctx context.Context, creq chan inter
 			// add work
 			cwork <- 1
 
-			reqParam = httpSrv.saveReqParam(req)
-			toBuffer = httpSrv.properties.EnableUpfrontQ && httpSrv.canBeBuffered(reqParam)
-			if !toBuffer {
-				resParam, toBuffer, err = httpSrv.dialAndSend(ctx, reqParam)
-				if err == nil {
-					err = httpSrv.Write(resParam)
-					if err != nil {
-						//fmt.Fprintf(os.Stderr, "Error on writing to client conn\n")
-						go errorlog.LogGenericError("Error on writing to client conn")
+			respond, buffered := false, false
+			var bodyErr error
+			if reqParam, bodyErr = httpSrv.saveReqParam(req); bodyErr != nil {
+				// never forward or buffer a request whose body was lost
+				go errorlog.LogGenericError("Error on saving request body -- " + bodyErr.Error())
+				resParam, respond = httpSrv.getCustomResponse(reqParam.Protocol, http.StatusServiceUnavailable, "Request Body Not Saved"), true
+			} else if httpSrv.isStatusRequest(reqParam) {
+				resParam, respond = httpSrv.getStatusResponse(reqParam), true
+			} else if err = httpSrv.setDeliverAt(&reqParam); err != nil {
+				resParam, respond = httpSrv.getCustomResponse(reqParam.Protocol, http.StatusBadRequest, "Invalid Delivery Time"), true
+			} else if resParam, respond = httpSrv.checkIdempotencyKey(q, &reqParam); !respond {
+				bufferable := httpSrv.canBeBuffered(reqParam)
+				toBuffer = httpSrv.properties.EnableUpfrontQ && bufferable
+				if reqParam.OrderingKey != "" && q.Ordered(reqParam.OrderingKey) {
+					// queue behind earlier requests of key, or refuse if it may not be queued at all
+					if bufferable && (httpSrv.properties.EnableUpfrontQ || httpSrv.properties.EnableDeferredQ) {
+						toBuffer = true
+					} else {
+						resParam, respond = httpSrv.getCustomResponse(reqParam.Protocol, http.StatusServiceUnavailable, "Ordering Key Queued"), true
+					}
+				}
+				if !toBuffer && !respond {
+					resParam, toBuffer, err = httpSrv.dialAndSend(ctx, reqParam)
+					reqParam.Attempts++
+					respond = err == nil
+				}
+
+				// to buffer?
+				if toBuffer {
+					if err = httpSrv.buffer(q, &reqParam); err == nil {
+						buffered = true
+						if httpSrv.properties.QAsyncAccept {
+							resParam, respond = httpSrv.getAcceptedResponse(reqParam), true
+						} else if !respond {
+							resParam, respond = httpSrv.getCustomResponse(reqParam.Protocol, http.StatusServiceUnavailable, "Request Buffered"), true
+						}
+					} else if err == queue.ErrQueueFull {
+						resParam, respond = httpSrv.getCustomResponse(reqParam.Protocol, http.StatusServiceUnavailable, "Queue Full"), true
+						resParam.Headers["Retry-After"] = []string{strconv.Itoa(httpSrv.properties.QOverflowRetryAfter)}
+					} else {
+						go errorlog.LogGenericError("Error on buffering request -- " + err.Error())
+						resParam, respond = httpSrv.getCustomResponse(reqParam.Protocol, http.StatusServiceUnavailable, ""), true
 					}
 				}
+
+				if !buffered {
+					httpSrv.settleIdempotencyKey(reqParam, respond, resParam)
+				}
 			}
 
-			// to buffer?
-			if toBuffer {
-				creq <- reqParam
-				cwork <- 1
+			if !buffered {
+				spool.Release(reqParam)
+			}
+
+			if respond {
+				if err = httpSrv.Write(resParam); err != nil {
+					//fmt.Fprintf(os.Stderr, "Error on writing to client conn\n")
+					go errorlog.LogGenericError("Error on writing to client conn")
+				}
 			}
 
 			// remove work
 			<-cwork
 
-			// check if a conn is to be closed
-			if httpSrv.optCloseConn(reqParam) {
+			// check if a conn is to be closed, a partly read body leaves it unusable
+			if bodyErr != nil {
+				httpSrv.forceCloseConn()
+				break
+			} else if httpSrv.optCloseConn(reqParam) {
 				break
 			}
 		} else {
@@ -192,30 +357,225 @@ func (httpSrv *HTTPService) ExecuteRealTime(ctx context.Context, creq chan inter
 	}
 }
 
-// ExecuteBuffered retries buffered requests by calling dialAndSend()
-func (httpSrv *HTTPService) ExecuteBuffered(ctx context.Context, creq chan interface{}, cwork chan int) {
+// ExecuteBuffered replays buffered requests by calling dialAndSend() whenever q has ready requests,
+// until ctx is done. A request that failed a replay is held back in queue for Q_REPLAY_BACKOFF, doubled
+// on every further attempt up to Q_REPLAY_BACKOFF_MAX, with jitter, while the worker moves on to other
+// ready requests. Requests exceeding Q_MAX_ATTEMPTS or Q_MAX_AGE are moved to the dead-letter queue
+// instead of being re-buffered. Replays are held while circuits to all nodes are open.
+func (httpSrv *HTTPService) ExecuteBuffered(ctx context.Context, q model.Queue) {
 
-	for {
-		if len(cwork) > 0 && len(creq) > 0 {
+	stop := httpSrv.shutdown(ctx)
 
-			reqParam := (<-creq).(model.RequestParam)
-			// send from buffer
-			_, toBuffer, _ := httpSrv.dialAndSend(ctx, reqParam)
+	for stop.Err() == nil {
 
-			// to buffer?
-			if toBuffer {
-				creq <- reqParam
-				cwork <- 1
+		// hold replays while circuits to all nodes are open
+		if wait := algorithm.CircuitWait(httpSrv.properties); wait > 0 {
+			select {
+			case <-stop.Done():
+			case <-time.After(wait):
 			}
+			continue
+		}
 
-			// remove work
-			<-cwork
+		reqParam, ok := q.Dequeue()
+		if !ok {
+			select {
+			case <-stop.Done():
+			case <-q.Notify(): // wait for more work
+			}
+			continue
+		}
 
+		// drop if another request with same idempotency key got in first
+		if httpSrv.isDuplicate(reqParam) {
+			q.Ack(reqParam)
+			spool.Release(reqParam)
+			go errorlog.LogGenericError("Dropped duplicate buffered request " + reqParam.Method + " " + reqParam.RequestURI + " with idempotency key " + reqParam.IdempotencyKey)
+			continue
+		}
+
+		// send from buffer, unless exhausted while waiting
+		var resParam model.ResponseParam
+		toBuffer := true
+		if !queue.Exhausted(httpSrv.properties, reqParam) {
+			if httpSrv.drain != nil {
+				if err := httpSrv.drain.Wait(stop); err != nil {
+					q.Nack(reqParam)
+					return
+				}
+			}
+			resParam, toBuffer, _ = httpSrv.dialAndSend(ctx, httpSrv.stampReplay(reqParam))
+			reqParam.Attempts++
+			if toBuffer && httpSrv.drain != nil {
+				httpSrv.drain.Failure()
+			} else if httpSrv.drain != nil {
+				httpSrv.drain.Success()
+			}
+		}
+
+		// to buffer?
+		if toBuffer && !queue.Exhausted(httpSrv.properties, reqParam) {
+			reqParam.RetryAt = time.Now().Add(jitter(httpSrv.replayBackoff(reqParam.Attempts)))
+			q.Nack(reqParam)
+		} else if toBuffer {
+			httpSrv.deadLetter(ctx, q, reqParam)
 		} else {
-			time.Sleep(time.Duration(httpSrv.properties.IdleGap) * time.Millisecond) // wait for more work
+			q.Ack(reqParam)
+			spool.Release(reqParam)
+			httpSrv.setResult(reqParam, result.STATE_DELIVERED, resParam)
+			httpSrv.sendCallback(ctx, reqParam, result.STATE_DELIVERED, resParam)
+		}
+	}
+}
+
+// shutdown returns context done once graceful shutdown starts, or ctx if no shutdown is set
+func (httpSrv *HTTPService) shutdown(ctx context.Context) context.Context {
+
+	if httpSrv.stop == nil {
+		return ctx
+	}
+
+	return httpSrv.stop
+}
+
+// closeIdle interrupts a read waiting for the next request on conn once stop is done, until done is closed
+func (httpSrv *HTTPService) closeIdle(stop context.Context, done chan struct{}) {
+
+	select {
+	case <-done:
+	case <-stop.Done():
+		httpSrv.connMu.Lock()
+		httpSrv.connStopped = true
+		if httpSrv.connIdle {
+			(*httpSrv.inTCPConn).SetReadDeadline(time.Now())
 		}
+		httpSrv.connMu.Unlock()
+	}
+}
+
+// setIdle marks whether conn is waiting for the next request, it returns false if conn is to be closed
+func (httpSrv *HTTPService) setIdle(idle bool) bool {
+
+	httpSrv.connMu.Lock()
+	defer httpSrv.connMu.Unlock()
+
+	httpSrv.connIdle = idle && !httpSrv.connStopped
+
+	return !httpSrv.connStopped
+}
+
+// stampReplay adds replay metadata headers (Q_REPLAY_HEADERS) to a copy of a buffered request, so that
+// upstream can tell it from a live one: stable request id, original receive time, attempt number and queue wait (ms)
+func (httpSrv *HTTPService) stampReplay(reqParam model.RequestParam) model.RequestParam {
+
+	if !httpSrv.properties.QReplayHeaders {
+		return reqParam
+	}
+
+	headers := make(map[string][]string, len(reqParam.Headers)+4)
+	for k, v := range reqParam.Headers {
+		headers[k] = v
+	}
+	receivedAt := reqParam.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = reqParam.EnqueuedAt
+	}
+	headers[HEADER_REQUEST_ID] = []string{reqParam.Id}
+	headers[HEADER_RECEIVED_AT] = []string{receivedAt.UTC().Format(time.RFC3339Nano)}
+	headers[HEADER_ATTEMPT] = []string{strconv.Itoa(reqParam.Attempts + 1)}
+	headers[HEADER_QUEUE_WAIT] = []string{strconv.FormatInt(int64(time.Since(reqParam.EnqueuedAt)/time.Millisecond), 10)}
+	reqParam.Headers = headers
+
+	return reqParam
+}
+
+// replayBackoff returns how long a request is held back after its failed replay number attempts,
+// Q_REPLAY_BACKOFF doubled on every further attempt and capped at Q_REPLAY_BACKOFF_MAX
+func (httpSrv *HTTPService) replayBackoff(attempts int) time.Duration {
+
+	backoff := time.Duration(httpSrv.properties.QReplayBackoff) * time.Millisecond
+	backoffMax := time.Duration(httpSrv.properties.QReplayBackoffMax) * time.Millisecond
+	for i := 1; i < attempts && backoff < backoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > backoffMax {
+		backoff = backoffMax
+	}
+
+	return backoff
+}
+
+// jitter returns a random duration between half of d and d, so that requests do not retry in lockstep
+func jitter(d time.Duration) time.Duration {
+
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(mathrand.Int63n(int64(d/2)+1))
+}
+
+// deadLetter moves an exhausted request out of the queue into the dead-letter queue
+func (httpSrv *HTTPService) deadLetter(ctx context.Context, q model.Queue, reqParam model.RequestParam) {
+
+	reqDesc := reqParam.Method + " " + reqParam.RequestURI + " after " + strconv.Itoa(reqParam.Attempts) + " attempts"
+
+	if httpSrv.deadLetterQ == nil {
+		q.Ack(reqParam)
+		spool.Release(reqParam)
+		httpSrv.setResult(reqParam, result.STATE_DEAD_LETTERED, model.ResponseParam{})
+		httpSrv.sendCallback(ctx, reqParam, result.STATE_DEAD_LETTERED, model.ResponseParam{})
+		go errorlog.LogGenericError("Dropped buffered request " + reqDesc)
+		return
+	}
+
+	if err := queue.DeadLetter(q, httpSrv.deadLetterQ, reqParam); err != nil {
+		q.Nack(reqParam)
+		go errorlog.LogGenericError("Error on dead-lettering request " + reqDesc + " -- " + err.Error())
+		return
+	}
+	httpSrv.setResult(reqParam, result.STATE_DEAD_LETTERED, model.ResponseParam{})
+	httpSrv.sendCallback(ctx, reqParam, result.STATE_DEAD_LETTERED, model.ResponseParam{})
+	go errorlog.LogGenericError("Dead-lettered buffered request " + reqDesc)
+}
+
+// buffer assigns a request id, if not assigned yet, and adds request to queue
+func (httpSrv *HTTPService) buffer(q model.Queue, reqParam *model.RequestParam) error {
+
+	if reqParam.Id == "" {
+		reqParam.Id = newRequestId()
+	}
+	if reqParam.Priority == "" {
+		reqParam.Priority, _ = httpSrv.matchRequestFormat(*reqParam)
 	}
 
+	if err := q.Enqueue(*reqParam); err != nil {
+		return err
+	}
+	httpSrv.setResult(*reqParam, result.STATE_QUEUED, model.ResponseParam{})
+
+	return nil
+}
+
+// setResult records state (and response, once delivered) of a buffered request
+func (httpSrv *HTTPService) setResult(reqParam model.RequestParam, state string, resParam model.ResponseParam) {
+
+	if httpSrv.keys != nil && reqParam.IdempotencyKey != "" {
+		httpSrv.keys.Set(reqParam.IdempotencyKey, reqParam.Id, state, resParam)
+	}
+
+	if httpSrv.results == nil {
+		return
+	}
+
+	switch state {
+	case result.STATE_QUEUED:
+		httpSrv.results.Queued(reqParam.Id)
+	case result.STATE_DELIVERED:
+		httpSrv.results.Delivered(reqParam.Id, resParam)
+	case result.STATE_DEAD_LETTERED:
+		httpSrv.results.DeadLettered(reqParam.Id)
+	}
 }
 
 // Discard sets error response and discards client http connection
@@ -243,13 +603,16 @@ func (httpSrv *HTTPService) Discard(ctx context.Context) {
 	httpSrv.forceCloseConn()
 }
 
-// saveReqParam parses and temporarily saves http request
-func (httpSrv *HTTPService) saveReqParam(req *http.Request) model.RequestParam {
+// saveReqParam parses and temporarily saves http request, it returns an error if the body could not be
+// read or spooled, along with the rest of the request
+func (httpSrv *HTTPService) saveReqParam(req *http.Request) (model.RequestParam, error) {
 
 	var reqParam model.RequestParam
+	var bodyErr error
 
 	reqParam.Protocol = req.Proto
 	reqParam.Method = req.Method
+	reqParam.ReceivedAt = time.Now()
 
 	if req.URL.RawQuery != "" {
 		reqParam.RequestURI = req.URL.Path + "?" + req.URL.RawQuery
@@ -257,9 +620,43 @@ func (httpSrv *HTTPService) saveReqParam(req *http.Request) model.RequestParam {
 		reqParam.RequestURI = req.URL.Path
 	}
 
-	if req.Body != nil {
-		if bodyBuff, err := ioutil.ReadAll(req.Body); err == nil {
-			reqParam.BodyBuff = bodyBuff
+	if req.Body != nil && httpSrv.spooler != nil {
+		bodyErr = httpSrv.spooler.Save(&reqParam, req.Body)
+	} else if req.Body != nil {
+		reqParam.BodyBuff, bodyErr = ioutil.ReadAll(req.Body)
+	}
+
+	if httpSrv.keys != nil {
+		reqParam.IdempotencyKey = req.Header.Get(HEADER_IDEMPOTENCY_KEY)
+	}
+
+	switch partitionBy := httpSrv.properties.QPartitionBy; {
+	case partitionBy == "route":
+		reqParam.Partition = req.URL.Path
+	case partitionBy == "host":
+		reqParam.Partition = req.Host
+	case strings.HasPrefix(partitionBy, "header:"):
+		reqParam.Partition = req.Header.Get(strings.TrimPrefix(partitionBy, "header:"))
+	}
+
+	switch compactBy := httpSrv.properties.QCompactBy; {
+	case compactBy == "resource" && (req.Method == http.MethodPut || req.Method == http.MethodPatch):
+		reqParam.CompactionKey = reqParam.Method + " " + reqParam.RequestURI
+	case strings.HasPrefix(compactBy, "header:"):
+		reqParam.CompactionKey = req.Header.Get(strings.TrimPrefix(compactBy, "header:"))
+	}
+
+	// ordering key is meant for serviceq, not for upstream
+	if orderingKey := req.Header.Get(HEADER_ORDERING_KEY); orderingKey != "" {
+		req.Header.Del(HEADER_ORDERING_KEY)
+		reqParam.OrderingKey = orderingKey
+	}
+
+	// callback url is meant for serviceq, not for upstream
+	if callbackURL := req.Header.Get(callback.HEADER_CALLBACK_URL); callbackURL != "" {
+		req.Header.Del(callback.HEADER_CALLBACK_URL)
+		if httpSrv.callbacks != nil && httpSrv.callbacks.ValidURL(callbackURL) {
+			reqParam.CallbackURL = callbackURL
 		}
 	}
 
@@ -270,52 +667,92 @@ func (httpSrv *HTTPService) saveReqParam(req *http.Request) model.RequestParam {
 		}
 	}
 
-	return reqParam
+	return reqParam, bodyErr
 }
 
-// dialAndSend forwards request to upstream node selected by ChooseServiceIndex() and in case of
-// error, increments the error count, and retries for a maximum MaxRetries times. If the request succeedes,
-// the coresponding node error count is reset. If the request fails on all nodes, it can be set to buffer.
+// dialAndSend forwards request to upstream node selected by the balancer of its route and in case of
+// error, adds to the node error score, and retries for a maximum MaxRetries times. Response times of
+// nodes are recorded for latency-aware selection, and outcomes feed the circuit breaker of each node,
+// nodes with an open circuit are skipped. If the request fails on all nodes, it can be set to buffer.
 func (httpSrv *HTTPService) dialAndSend(ctx context.Context, reqParam model.RequestParam) (model.ResponseParam, bool, error) {
 
 	choice := -1
 	var nodeErr error
+	var failedRes model.ResponseParam
+	balancer := httpSrv.balancerFor(reqParam)
 
 	for retry := 0; retry < httpSrv.properties.MaxRetries; retry++ {
 
-		choice = algorithm.ChooseServiceIndex(httpSrv.properties, choice, retry)
+		choice = algorithm.Choose(balancer, httpSrv.properties, choice, retry)
 		upstrService := httpSrv.properties.ServiceList[choice]
 
-		body := ioutil.NopCloser(bytes.NewReader(reqParam.BodyBuff))
+		body, err := spool.Open(reqParam)
+		if err != nil {
+			go errorlog.LogGenericError("Error on reading spooled request body -- " + err.Error())
+			return model.ResponseParam{}, true, err
+		}
+
+		// fail fast on open circuit, without waiting on a node known to be down
+		if !algorithm.AllowRequest(httpSrv.properties, upstrService.QualifiedUrl) {
+			body.Close()
+			if nodeErr == nil {
+				nodeErr = errors.New(tcputils.RESPONSE_CIRCUIT_OPEN)
+			}
+			continue
+		}
+
 		upstrReq, _ := http.NewRequestWithContext(ctx, reqParam.Method, upstrService.QualifiedUrl+reqParam.RequestURI, body)
 		upstrReq.Header = reqParam.Headers
+		if reqParam.BodyFile != "" {
+			upstrReq.ContentLength = reqParam.BodySize
+		}
 
+		algorithm.StartRequest(httpSrv.properties, upstrService.QualifiedUrl)
+		sentAt := time.Now()
 		resp, err := httpSrv.outHTTPClient.Do(upstrReq)
+		var responseParam model.ResponseParam
+		if resp != nil && err == nil {
+			responseParam = readResponse(resp)
+			algorithm.RecordLatency(httpSrv.properties, upstrService.QualifiedUrl, time.Since(sentAt))
+		}
+		algorithm.FinishRequest(httpSrv.properties, upstrService.QualifiedUrl)
 
 		// handle response
-		if resp == nil || err != nil {
+		if resp != nil && err == nil && httpSrv.matchStatus(httpSrv.properties.UpstreamFailureStatus, reqParam, resp.StatusCode) {
+			nodeErr = errors.New(tcputils.RESPONSE_FAILED)
+			failedRes = responseParam
+			algorithm.RecordFailure(httpSrv.properties, upstrService.QualifiedUrl)
+			go errorlog.IncrementErrorCount(httpSrv.properties, upstrService.QualifiedUrl, tcputils.UPSTREAM_STATUS_ERR, resp.Status)
+
+			select { // wait on error
+			case <-ctx.Done():
+			case <-time.After(time.Duration(httpSrv.properties.RetryGap) * time.Second):
+			}
+			continue
+		} else if resp == nil || err != nil {
 			nodeErr = tcputils.EvalError(err)
+			algorithm.RecordFailure(httpSrv.properties, upstrService.QualifiedUrl)
 			go errorlog.IncrementErrorCount(httpSrv.properties, upstrService.QualifiedUrl, tcputils.UPSTREAM_HTTP_ERR, nodeErr.Error())
 
-			time.Sleep(time.Duration(httpSrv.properties.RetryGap) * time.Second) // wait on error
+			select { // wait on error
+			case <-ctx.Done():
+			case <-time.After(time.Duration(httpSrv.properties.RetryGap) * time.Second):
+			}
 			continue
 		} else {
 			nodeErr = nil
-			go errorlog.ResetErrorCount(httpSrv.properties, upstrService.QualifiedUrl)
-
-			// prepare response
-			responseParam := model.ResponseParam{}
-			responseParam.Protocol = resp.Proto
-			responseParam.Status = resp.Status
-			responseParam.Headers = resp.Header
-			if resp.Body != nil {
-				responseParam.BodyBuff, _ = ioutil.ReadAll(resp.Body)
-				resp.Body.Close()
-			}
-			return responseParam, false, nil
+			algorithm.RecordSuccess(httpSrv.properties, upstrService.QualifiedUrl)
+
+			return httpSrv.checkStatusAndRespond(responseParam, resp.StatusCode, reqParam)
 		}
 	}
 
+	// status based response, once all nodes failed with one
+	if nodeErr != nil && nodeErr.Error() == tcputils.RESPONSE_FAILED {
+		statusCode, _ := strconv.Atoi(strings.SplitN(failedRes.Status, " ", 2)[0])
+		return httpSrv.checkStatusAndRespond(failedRes, statusCode, reqParam)
+	}
+
 	// error based response
 	if nodeErr != nil {
 		return httpSrv.checkErrorAndRespond(nodeErr, reqParam)
@@ -324,10 +761,73 @@ func (httpSrv *HTTPService) dialAndSend(ctx context.Context, reqParam model.Requ
 	return model.ResponseParam{}, true, errors.New("send-fail")
 }
 
+// balancerFor returns balancer of first LB_ROUTE_STRATEGY route matching the request, or else of LB_STRATEGY
+func (httpSrv *HTTPService) balancerFor(reqParam model.RequestParam) algorithm.Balancer {
+
+	strategy := httpSrv.properties.LBStrategy
+	for _, rule := range httpSrv.properties.LBRouteStrategies {
+		if matchRule(rule.Route, reqParam.Method, requestPath(reqParam), reqParam.Headers) {
+			strategy = rule.Strategy
+			break
+		}
+	}
+
+	if balancer, ok := algorithm.GetBalancer(strategy); ok {
+		return balancer
+	}
+	balancer, _ := algorithm.GetBalancer(algorithm.STRATEGY_ERROR_WEIGHTED)
+
+	return balancer
+}
+
+// readResponse prepares response received from upstream node
+func readResponse(resp *http.Response) model.ResponseParam {
+
+	responseParam := model.ResponseParam{}
+	responseParam.Protocol = resp.Proto
+	responseParam.Status = resp.Status
+	responseParam.Headers = resp.Header
+	if resp.Body != nil {
+		responseParam.BodyBuff, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	return responseParam
+}
+
+// checkStatusAndRespond sets buffer flag if upstream response has a status listed in Q_ON_STATUS for
+// the request, or else passes the response on to client
+func (httpSrv *HTTPService) checkStatusAndRespond(resParam model.ResponseParam, statusCode int, reqParam model.RequestParam) (model.ResponseParam, bool, error) {
+
+	if httpSrv.properties.EnableDeferredQ && httpSrv.matchStatus(httpSrv.properties.QOnStatus, reqParam, statusCode) && httpSrv.canBeBuffered(reqParam) {
+		return httpSrv.getCustomResponse(reqParam.Protocol, http.StatusServiceUnavailable, "Request Buffered"), true, nil
+	}
+
+	return resParam, false, nil
+}
+
+// matchStatus determines whether status is listed for request in status rules (UPSTREAM_FAILURE_STATUS
+// or Q_ON_STATUS), taking the first rule matching the request route or else the rule without a route
+func (httpSrv *HTTPService) matchStatus(rules []model.StatusRule, reqParam model.RequestParam, statusCode int) bool {
+
+	var fallback *model.StatusRule
+	for i, rule := range rules {
+		if rule.Route == nil {
+			if fallback == nil {
+				fallback = &rules[i]
+			}
+		} else if matchRule(*rule.Route, reqParam.Method, requestPath(reqParam), reqParam.Headers) {
+			return rule.Statuses[statusCode]
+		}
+	}
+
+	return fallback != nil && fallback.Statuses[statusCode]
+}
+
 // checkErrorAndRespond sets error and buffer flag based on buffer config and type of error from upstream node
 func (httpSrv *HTTPService) checkErrorAndRespond(clientErr error, reqParam model.RequestParam) (model.ResponseParam, bool, error) {
 
-	if clientErr.Error() == tcputils.RESPONSE_NO_RESPONSE || clientErr.Error() == tcputils.RESPONSE_TIMED_OUT {
+	if clientErr.Error() == tcputils.RESPONSE_NO_RESPONSE || clientErr.Error() == tcputils.RESPONSE_TIMED_OUT || clientErr.Error() == tcputils.RESPONSE_CIRCUIT_OPEN {
 		if httpSrv.properties.EnableDeferredQ && httpSrv.canBeBuffered(reqParam) {
 			return httpSrv.getCustomResponse(reqParam.Protocol, http.StatusServiceUnavailable, "Request Buffered"), true, nil
 		} else {
@@ -363,32 +863,264 @@ func (httpSrv *HTTPService) getCustomResponse(protocol string, statusCode int, r
 // config in sq.properties. Http method and uri are matched against buffer config.
 func (httpSrv *HTTPService) canBeBuffered(reqParam model.RequestParam) bool {
 
-	reqFormats := httpSrv.properties.QRequestFormats
+	_, ok := httpSrv.matchRequestFormat(reqParam)
 
-	if reqFormats == nil || reqFormats[0] == "ALL" {
-		return true
+	return ok
+}
+
+// matchRequestFormat returns priority class of first Q_REQUEST_FORMATS rule matching the request,
+// and whether the request may be queued at all
+func (httpSrv *HTTPService) matchRequestFormat(reqParam model.RequestParam) (string, bool) {
+
+	rules := httpSrv.properties.QRequestRules
+
+	if rules == nil {
+		return model.PRIORITY_NORMAL, true
 	}
 
-	for _, rf := range reqFormats {
-		satisfy := false
-		rfBrkUp := strings.Split(rf, " ")
-		if (0 < len(rfBrkUp) && reqParam.Method == rfBrkUp[0]) || (0 >= len(rfBrkUp)) {
-			satisfy = true
-			if (1 < len(rfBrkUp) && reqParam.RequestURI == rfBrkUp[1]) || (1 >= len(rfBrkUp)) {
-				satisfy = true
-				if 2 < len(rfBrkUp) && rfBrkUp[2] == "!" {
-					satisfy = false
-				}
-			} else {
-				satisfy = false
-			}
+	path := requestPath(reqParam)
+	for _, rule := range rules {
+		if matchRule(rule, reqParam.Method, path, reqParam.Headers) {
+			return rule.Priority, !rule.Exclude
 		}
-		if satisfy {
-			return satisfy
+	}
+
+	return model.PRIORITY_NORMAL, false
+}
+
+// requestPath returns request uri without query string
+func requestPath(reqParam model.RequestParam) string {
+
+	if i := strings.IndexByte(reqParam.RequestURI, '?'); i != -1 {
+		return reqParam.RequestURI[:i]
+	}
+
+	return reqParam.RequestURI
+}
+
+// matchRule determines whether method, path and all header conditions of rule match a request
+func matchRule(rule model.RequestRule, method string, path string, headers http.Header) bool {
+
+	if rule.Method != "" && rule.Method != method {
+		return false
+	}
+	if rule.Path != nil && !rule.Path.MatchString(path) {
+		return false
+	}
+
+	for _, hr := range rule.Headers {
+		values := headers.Values(hr.Name)
+		if len(values) == 0 {
+			return false
+		}
+		if hr.Value != nil && !hr.Value.MatchString(strings.Join(values, ",")) {
+			return false
 		}
 	}
 
-	return false
+	return true
+}
+
+// sendCallback posts final state (and response, once delivered) of a buffered request to its callback url
+func (httpSrv *HTTPService) sendCallback(ctx context.Context, reqParam model.RequestParam, state string, resParam model.ResponseParam) {
+
+	if httpSrv.callbacks == nil {
+		return
+	}
+
+	httpSrv.callbacks.Send(ctx, reqParam, state, resParam)
+}
+
+// isStatusRequest determines whether a request polls for result of an asynchronously accepted request
+func (httpSrv *HTTPService) isStatusRequest(reqParam model.RequestParam) bool {
+
+	return httpSrv.properties.QAsyncAccept && reqParam.Method == http.MethodGet &&
+		strings.HasPrefix(reqParam.RequestURI, httpSrv.properties.QAsyncStatusRoute+"/")
+}
+
+// getAcceptedResponse creates a 202 response pointing client to status route of the buffered request
+func (httpSrv *HTTPService) getAcceptedResponse(reqParam model.RequestParam) model.ResponseParam {
+
+	resParam := httpSrv.getCustomResponse(reqParam.Protocol, http.StatusAccepted, "Request Accepted")
+	resParam.Headers["Location"] = []string{httpSrv.properties.QAsyncStatusRoute + "/" + reqParam.Id}
+	resParam.Headers[HEADER_REQUEST_ID] = []string{reqParam.Id}
+
+	return resParam
+}
+
+// getStatusResponse creates response for a status request
+func (httpSrv *HTTPService) getStatusResponse(reqParam model.RequestParam) model.ResponseParam {
+
+	id := strings.TrimPrefix(reqParam.RequestURI, httpSrv.properties.QAsyncStatusRoute+"/")
+	if i := strings.IndexByte(id, '?'); i != -1 {
+		id = id[:i]
+	}
+
+	var res result.Result
+	found := false
+	if httpSrv.results != nil {
+		res, found = httpSrv.results.Get(id)
+	}
+
+	if !found {
+		return httpSrv.getCustomResponse(reqParam.Protocol, http.StatusNotFound, "Request Not Found")
+	}
+
+	return httpSrv.getResultResponse(reqParam.Protocol, id, res)
+}
+
+// getResultResponse creates response from result of buffered request id. Delivered requests
+// get the upstream response, queued ones 202 and dead-lettered, superseded or removed ones 410.
+func (httpSrv *HTTPService) getResultResponse(protocol string, id string, res result.Result) model.ResponseParam {
+
+	var resParam model.ResponseParam
+	switch res.State {
+	case result.STATE_DELIVERED:
+		resParam = res.Response
+		resParam.Protocol = protocol
+		resParam.Headers = make(map[string][]string, len(res.Response.Headers)+1)
+		for k, v := range res.Response.Headers {
+			resParam.Headers[k] = v
+		}
+	case result.STATE_DEAD_LETTERED:
+		resParam = httpSrv.getCustomResponse(protocol, http.StatusGone, "Request Dead-Lettered")
+	case result.STATE_SUPERSEDED:
+		resParam = httpSrv.getCustomResponse(protocol, http.StatusGone, "Request Superseded")
+	case result.STATE_REMOVED:
+		resParam = httpSrv.getCustomResponse(protocol, http.StatusGone, "Request Removed")
+	default:
+		resParam = httpSrv.getCustomResponse(protocol, http.StatusAccepted, "Request Queued")
+	}
+	resParam.Headers[HEADER_REQUEST_ID] = []string{id}
+
+	return resParam
+}
+
+// setDeliverAt takes X-SQ-Deliver-At (RFC 3339 or unix seconds) or X-SQ-Delay (seconds) off a request
+// and holds it in queue until then. Delivery time is honoured on requests buffered upfront, others are sent right away.
+func (httpSrv *HTTPService) setDeliverAt(reqParam *model.RequestParam) error {
+
+	deliverAt, delay := "", ""
+	for k, v := range reqParam.Headers {
+		switch http.CanonicalHeaderKey(k) {
+		case HEADER_DELIVER_AT:
+			deliverAt = v[0]
+			delete(reqParam.Headers, k)
+		case HEADER_DELAY:
+			delay = v[0]
+			delete(reqParam.Headers, k)
+		}
+	}
+
+	var at time.Time
+	switch {
+	case deliverAt != "":
+		if unix, err := strconv.ParseInt(deliverAt, 10, 64); err == nil {
+			at = time.Unix(unix, 0)
+		} else if t, err := time.Parse(time.RFC3339, deliverAt); err == nil {
+			at = t
+		} else {
+			return err
+		}
+	case delay != "":
+		secs, err := strconv.ParseInt(delay, 10, 64)
+		if err != nil || secs < 0 {
+			return errors.New("invalid-delay")
+		}
+		at = time.Now().Add(time.Duration(secs) * time.Second)
+	default:
+		return nil
+	}
+
+	if httpSrv.properties.EnableUpfrontQ && httpSrv.canBeBuffered(*reqParam) {
+		reqParam.DeliverAt = at
+	}
+
+	return nil
+}
+
+// checkIdempotencyKey claims the idempotency key of a request. A repeated request is answered
+// with the stored result of the first one (or its queue position), a request reusing a key for a
+// different method/uri with 422, and one racing the first request with 409.
+func (httpSrv *HTTPService) checkIdempotencyKey(q model.Queue, reqParam *model.RequestParam) (model.ResponseParam, bool) {
+
+	if httpSrv.keys == nil || reqParam.IdempotencyKey == "" {
+		return model.ResponseParam{}, false
+	}
+
+	reqParam.Id = newRequestId()
+	entry, claimed := httpSrv.keys.Claim(reqParam.IdempotencyKey, result.Fingerprint(*reqParam), reqParam.Id)
+	if claimed {
+		return model.ResponseParam{}, false
+	}
+
+	var resParam model.ResponseParam
+	switch {
+	case entry.Fingerprint != result.Fingerprint(*reqParam):
+		return httpSrv.getCustomResponse(reqParam.Protocol, http.StatusUnprocessableEntity, "Idempotency Key Reused"), true
+	case entry.Result.State == result.STATE_IN_PROGRESS:
+		return httpSrv.getCustomResponse(reqParam.Protocol, http.StatusConflict, "Request In Progress"), true
+	case entry.Result.State == result.STATE_QUEUED:
+		resParam = httpSrv.getResultResponse(reqParam.Protocol, entry.RequestId, entry.Result)
+		if pos := queuePosition(q, entry.RequestId); pos > 0 {
+			resParam.Headers[HEADER_QUEUE_POSITION] = []string{strconv.Itoa(pos)}
+		}
+	default:
+		resParam = httpSrv.getResultResponse(reqParam.Protocol, entry.RequestId, entry.Result)
+	}
+	resParam.Headers[HEADER_IDEMPOTENT_REPLAYED] = []string{"true"}
+
+	return resParam, true
+}
+
+// settleIdempotencyKey stores the response of a request that was not buffered against its idempotency
+// key. Keys of requests that failed at the gateway (no response, 502, 503, 504) are released for retries.
+func (httpSrv *HTTPService) settleIdempotencyKey(reqParam model.RequestParam, responded bool, resParam model.ResponseParam) {
+
+	if httpSrv.keys == nil || reqParam.IdempotencyKey == "" {
+		return
+	}
+
+	statusCode, _ := strconv.Atoi(strings.SplitN(resParam.Status, " ", 2)[0])
+	if !responded || statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout {
+		httpSrv.keys.Release(reqParam.IdempotencyKey, reqParam.Id)
+		return
+	}
+
+	httpSrv.keys.Set(reqParam.IdempotencyKey, reqParam.Id, result.STATE_DELIVERED, resParam)
+}
+
+// isDuplicate determines whether the idempotency key of a buffered request is held by another request
+func (httpSrv *HTTPService) isDuplicate(reqParam model.RequestParam) bool {
+
+	if httpSrv.keys == nil || reqParam.IdempotencyKey == "" {
+		return false
+	}
+
+	holder, ok := httpSrv.keys.Holder(reqParam.IdempotencyKey)
+
+	return ok && holder != reqParam.Id
+}
+
+// queuePosition returns 1-based position of request id in queue, 0 if not found
+func queuePosition(q model.Queue, id string) int {
+
+	for i, reqParam := range q.List() {
+		if reqParam.Id == id {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// newRequestId returns a random 128-bit request id in hex
+func newRequestId() string {
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
 }
 
 // optCloseConn determines to optionally close a net.Conn object
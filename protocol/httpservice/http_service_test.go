@@ -0,0 +1,287 @@
+package httpservice
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
+	"github.com/gptankit/serviceq/queue"
+	"github.com/gptankit/serviceq/result"
+)
+
+// newProperties returns properties forwarding to a single upstream node at url
+func newProperties(url string) *model.ServiceQProperties {
+
+	return &model.ServiceQProperties{
+		Proto:             "http",
+		ServiceList:       []model.Endpoint{{RawUrl: url, QualifiedUrl: url, Weight: 1}},
+		MaxConcurrency:    10,
+		MaxRetries:        1,
+		ErrorScores:       make(map[string]model.ErrorScore),
+		ErrorHalfLife:     60,
+		ErrorExponent:     2,
+		Latencies:         make(map[string]model.LatencyStats),
+		LatencyAlpha:      0.2,
+		LatencyWindow:     100,
+		Circuits:          make(map[string]model.CircuitBreaker),
+		Outstanding:       make(map[string]int64),
+		OutRequestTimeout: 5,
+		KeepAliveTimeout:  10,
+		KeepAliveServe:    true,
+		QReplayBackoff:    10,
+		QReplayBackoffMax: 10,
+		QAsyncStatusRoute: "/serviceq/requests",
+		QAsyncResultTTL:   60,
+	}
+}
+
+// client is the client end of a connection served by ExecuteRealTime
+type client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// serve starts ExecuteRealTime on one end of an in-memory connection and returns the other end
+func serve(t *testing.T, sqp *model.ServiceQProperties, q model.Queue, httpSrvOptions ...HTTPServiceOption) *client {
+
+	clientConn, serverConn := net.Pipe()
+	httpSrv := New(sqp, append([]HTTPServiceOption{WithIncomingTCPConn(&serverConn)}, httpSrvOptions...)...)
+	go httpSrv.ExecuteRealTime(context.Background(), q, make(chan int, sqp.MaxConcurrency+1))
+	t.Cleanup(func() { clientConn.Close() })
+
+	return &client{conn: clientConn, reader: bufio.NewReader(clientConn)}
+}
+
+// do sends a request on the connection and returns the response with its body, failing if none arrives
+func (c *client) do(t *testing.T, method string, target string, headers map[string]string) (*http.Response, string) {
+
+	req := httptest.NewRequest(method, target, strings.NewReader("{}"))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := req.Write(c.conn); err != nil {
+		t.Fatalf("request %s %s not written -- %v", method, target, err)
+	}
+	resp, err := http.ReadResponse(c.reader, req)
+	if err != nil {
+		t.Fatalf("no response to %s %s -- %v", method, target, err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	return resp, string(body)
+}
+
+// replay starts ExecuteBuffered on q until the test ends
+func replay(t *testing.T, sqp *model.ServiceQProperties, q model.Queue, httpSrvOptions ...HTTPServiceOption) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go New(sqp, httpSrvOptions...).ExecuteBuffered(ctx, q)
+	t.Cleanup(cancel)
+}
+
+// waitFor polls cond until it holds, failing after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestAsyncAccept(t *testing.T) {
+
+	var mu sync.Mutex
+	down := true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer upstream.Close()
+
+	sqp := newProperties(upstream.URL)
+	sqp.EnableDeferredQ = true
+	sqp.QOnStatus = []model.StatusRule{{Statuses: map[int]bool{http.StatusServiceUnavailable: true}}}
+	sqp.QAsyncAccept = true
+	q, results := queue.NewMemoryQueue(), result.NewStore(time.Minute)
+	c := serve(t, sqp, q, WithResultStore(results))
+
+	// buffered on upstream 503, answered with where to poll
+	resp, body := c.do(t, "POST", "/orders", nil)
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusAccepted || !strings.HasPrefix(location, sqp.QAsyncStatusRoute+"/") || resp.Header.Get(HEADER_REQUEST_ID) == "" || q.Len() != 1 {
+		t.Fatalf("expected 202 with status location, got %s %s, location=%q, q=%d\n", resp.Status, body, location, q.Len())
+	}
+
+	if resp, body := c.do(t, "GET", location, nil); resp.StatusCode != http.StatusAccepted || !strings.Contains(body, "Request Queued") {
+		t.Errorf("expected queued status, got %s %s\n", resp.Status, body)
+	}
+	if resp, _ := c.do(t, "GET", sqp.QAsyncStatusRoute+"/unknown", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected %d for unknown request id, got %s\n", http.StatusNotFound, resp.Status)
+	}
+
+	// delivered once upstream is back, status route answers with the upstream response
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	replay(t, sqp, q, WithResultStore(results))
+	waitFor(t, "replay", func() bool { return q.Len() == 0 })
+
+	if resp, body := c.do(t, "GET", location, nil); resp.StatusCode != http.StatusCreated || body != "created" {
+		t.Errorf("expected upstream response once delivered, got %s %s\n", resp.Status, body)
+	}
+}
+
+func TestOrderingKey(t *testing.T) {
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request overtook earlier requests of its ordering key")
+	}))
+	defer upstream.Close()
+
+	q := queue.NewMemoryQueue()
+	q.Enqueue(model.RequestParam{Protocol: "HTTP/1.1", Method: "POST", RequestURI: "/orders", OrderingKey: "acct-1"})
+
+	// not queueable, must neither overtake nor hang
+	sqp := newProperties(upstream.URL)
+	c := serve(t, sqp, q)
+	if resp, body := c.do(t, "POST", "/orders", map[string]string{HEADER_ORDERING_KEY: "acct-1"}); resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "Ordering Key Queued") || q.Len() != 1 {
+		t.Errorf("expected refusal of unqueueable request, got %s %s, q=%d\n", resp.Status, body, q.Len())
+	}
+
+	// queueable, answered as buffered
+	sqp = newProperties(upstream.URL)
+	sqp.EnableDeferredQ = true
+	c = serve(t, sqp, q)
+	if resp, body := c.do(t, "POST", "/orders", map[string]string{HEADER_ORDERING_KEY: "acct-1"}); resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "Request Buffered") || q.Len() != 2 {
+		t.Errorf("expected request queued behind its key, got %s %s, q=%d\n", resp.Status, body, q.Len())
+	}
+
+	// excluded by Q_REQUEST_FORMATS
+	sqp.QRequestRules = []model.RequestRule{{Method: "PUT"}}
+	c = serve(t, sqp, q)
+	if resp, _ := c.do(t, "POST", "/orders", map[string]string{HEADER_ORDERING_KEY: "acct-1"}); resp.StatusCode != http.StatusServiceUnavailable || q.Len() != 2 {
+		t.Errorf("expected refusal of request excluded from queue, got %s, q=%d\n", resp.Status, q.Len())
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+
+	var mu sync.Mutex
+	calls := 0
+	received, release := make(chan struct{}, 1), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		if r.URL.Path == "/slow" {
+			received <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer upstream.Close()
+
+	sqp := newProperties(upstream.URL)
+	q, keys := queue.NewMemoryQueue(), result.NewKeyStore(time.Minute)
+	c := serve(t, sqp, q, WithKeyStore(keys))
+
+	// repeat is answered with the stored response, without reaching upstream
+	c.do(t, "POST", "/orders", map[string]string{HEADER_IDEMPOTENCY_KEY: "k1"})
+	resp, body := c.do(t, "POST", "/orders", map[string]string{HEADER_IDEMPOTENCY_KEY: "k1"})
+	mu.Lock()
+	if resp.StatusCode != http.StatusCreated || body != "created" || resp.Header.Get(HEADER_IDEMPOTENT_REPLAYED) != "true" || calls != 1 {
+		t.Errorf("expected stored response replayed, got %s %s, replayed=%q, calls=%d\n", resp.Status, body, resp.Header.Get(HEADER_IDEMPOTENT_REPLAYED), calls)
+	}
+	mu.Unlock()
+
+	// key reused for another request
+	if resp, body := c.do(t, "POST", "/payments", map[string]string{HEADER_IDEMPOTENCY_KEY: "k1"}); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected %d on key reused for another request, got %s %s\n", http.StatusUnprocessableEntity, resp.Status, body)
+	}
+
+	// repeat racing the original, still in flight on another connection
+	first := serve(t, sqp, q, WithKeyStore(keys))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("POST", "/slow", nil)
+		req.Header.Set(HEADER_IDEMPOTENCY_KEY, "k2")
+		req.Write(first.conn) // not through do, which may not fail the test from here
+		http.ReadResponse(first.reader, req)
+	}()
+	<-received
+	if resp, body := c.do(t, "POST", "/slow", map[string]string{HEADER_IDEMPOTENCY_KEY: "k2"}); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected %d on repeat of request in flight, got %s %s\n", http.StatusConflict, resp.Status, body)
+	}
+	close(release)
+	<-done
+}
+
+func TestDuplicateDropped(t *testing.T) {
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("duplicate buffered request forwarded")
+	}))
+	defer upstream.Close()
+
+	// key taken over by a later request while this one was queued
+	q, keys := queue.NewMemoryQueue(), result.NewKeyStore(time.Minute)
+	keys.Claim("k1", "POST /orders", "r2")
+	q.Enqueue(model.RequestParam{Id: "r1", Protocol: "HTTP/1.1", Method: "POST", RequestURI: "/orders", IdempotencyKey: "k1"})
+
+	replay(t, newProperties(upstream.URL), q, WithKeyStore(keys))
+	waitFor(t, "duplicate dropped", func() bool { return q.Len() == 0 })
+}
+
+func TestReplayHeaders(t *testing.T) {
+
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer upstream.Close()
+
+	for _, stamped := range []bool{true, false} {
+		sqp := newProperties(upstream.URL)
+		sqp.QReplayHeaders = stamped
+		q := queue.NewMemoryQueue()
+		receivedAt := time.Now().Add(-time.Minute)
+		q.Enqueue(model.RequestParam{Id: "r1", Protocol: "HTTP/1.1", Method: "POST", RequestURI: "/orders", ReceivedAt: receivedAt, Attempts: 2})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go New(sqp).ExecuteBuffered(ctx, q)
+
+		select {
+		case headers := <-received:
+			if stamped && (headers.Get(HEADER_REQUEST_ID) != "r1" || headers.Get(HEADER_ATTEMPT) != "3" ||
+				headers.Get(HEADER_RECEIVED_AT) != receivedAt.UTC().Format(time.RFC3339Nano) || headers.Get(HEADER_QUEUE_WAIT) == "") {
+				t.Errorf("replay headers not set as expected, got %v\n", headers)
+			}
+			if !stamped && (headers.Get(HEADER_REQUEST_ID) != "" || headers.Get(HEADER_ATTEMPT) != "" || headers.Get(HEADER_RECEIVED_AT) != "" || headers.Get(HEADER_QUEUE_WAIT) != "") {
+				t.Errorf("replay headers set with Q_REPLAY_HEADERS=false, got %v\n", headers)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("buffered request not replayed\n")
+		}
+		cancel()
+	}
+}
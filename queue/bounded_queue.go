@@ -0,0 +1,348 @@
+package queue
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
+	"github.com/gptankit/serviceq/wal"
+)
+
+const (
+	OVERFLOW_REJECT      = "reject"
+	OVERFLOW_DROP_OLDEST = "drop-oldest"
+	OVERFLOW_SPILL       = "spill"
+
+	spillDir    = "spill"
+	spillSeqBit = uint64(1) << 63 // marks seqs of spilled requests, which are numbered by their own log
+)
+
+// ErrQueueFull is returned by Enqueue when a request does not fit into a BoundedQueue
+var ErrQueueFull = errors.New("queue-full")
+
+var _ model.Queue = &BoundedQueue{}
+
+// BoundedQueue limits number of requests and body bytes held by a queue (Q_MAX_ITEMS, Q_MAX_BYTES).
+// Once full, new requests are rejected, make room by dropping the oldest waiting requests, or are
+// spilled to an on-disk overflow queue and moved back in order as room frees up (Q_OVERFLOW).
+type BoundedQueue struct {
+	mu       sync.Mutex
+	q        model.Queue
+	spill    *FileQueue
+	maxItems int
+	maxBytes int64
+	policy   string
+	bytes    int64 // body bytes held by q
+	onDrop   func(model.RequestParam)
+	stop     chan struct{}
+}
+
+// NewBounded wraps q with the limits and overflow policy configured in sq.properties. onDrop
+// is called with every request dropped to make room. Spilled requests are kept in QWALDir/spill.
+func NewBounded(sqp *model.ServiceQProperties, q model.Queue, onDrop func(model.RequestParam)) (*BoundedQueue, error) {
+
+	bq := &BoundedQueue{
+		q:        q,
+		maxItems: sqp.QMaxItems,
+		maxBytes: sqp.QMaxBytes,
+		policy:   sqp.QOverflow,
+		onDrop:   onDrop,
+		stop:     make(chan struct{}),
+	}
+	for _, reqParam := range q.List() {
+		bq.bytes += BodySize(reqParam)
+	}
+
+	if bq.policy == OVERFLOW_SPILL {
+		fsync, err := wal.ParseFsyncPolicy(sqp.QWALFsync)
+		if err != nil {
+			return nil, err
+		}
+		if bq.spill, err = NewFileQueue(filepath.Join(sqp.QWALDir, spillDir), wal.Options{
+			SegmentSize:   sqp.QWALSegmentSize << 20,
+			Fsync:         fsync,
+			FsyncInterval: time.Duration(sqp.QWALFsyncInterval) * time.Millisecond,
+		}); err != nil {
+			return nil, err
+		}
+		bq.spill.SetWeights(sqp.QPriorityWeights)
+		bq.refill()
+		go bq.watchSpill()
+	}
+
+	return bq, nil
+}
+
+// Enqueue adds request if it fits, applying overflow policy otherwise
+func (bq *BoundedQueue) Enqueue(reqParam model.RequestParam) error {
+
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+
+	size := BodySize(reqParam)
+	if bq.maxBytes > 0 && size > bq.maxBytes {
+		return ErrQueueFull
+	}
+
+	// keep FIFO order while requests are spilled
+	if bq.spill != nil && bq.spill.Len() > 0 {
+		return bq.spill.Enqueue(reqParam)
+	}
+
+	if !bq.fits(size) {
+		switch bq.policy {
+		case OVERFLOW_DROP_OLDEST:
+			if !bq.dropOldest(size) {
+				return ErrQueueFull
+			}
+		case OVERFLOW_SPILL:
+			return bq.spill.Enqueue(reqParam)
+		default:
+			return ErrQueueFull
+		}
+	}
+
+	if err := bq.q.Enqueue(reqParam); err != nil {
+		return err
+	}
+	bq.bytes += size
+
+	return nil
+}
+
+// Compact enables compaction by CompactionKey of queued requests, spilled ones are compacted once moved back
+func (bq *BoundedQueue) Compact(onSupersede func(model.RequestParam)) {
+
+	compactor, ok := bq.q.(Compactor)
+	if !ok {
+		return
+	}
+
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+
+	// requests are only pushed into q with mu held
+	compactor.Compact(func(reqParam model.RequestParam) {
+		bq.bytes -= BodySize(reqParam)
+		if onSupersede != nil {
+			onSupersede(reqParam)
+		}
+	})
+}
+
+// Superseded returns number of requests superseded since compaction was enabled
+func (bq *BoundedQueue) Superseded() uint64 {
+
+	if compactor, ok := bq.q.(Compactor); ok {
+		return compactor.Superseded()
+	}
+
+	return 0
+}
+
+// Dequeue takes next ready request out for delivery
+func (bq *BoundedQueue) Dequeue() (model.RequestParam, bool) {
+
+	bq.mu.Lock()
+	bq.refill()
+	bq.mu.Unlock()
+
+	return bq.q.Dequeue()
+}
+
+// Ack forgets a delivered request, making room for spilled ones
+func (bq *BoundedQueue) Ack(reqParam model.RequestParam) error {
+
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+
+	if err := bq.q.Ack(reqParam); err != nil {
+		return err
+	}
+	bq.bytes -= BodySize(reqParam)
+	bq.refill()
+
+	return nil
+}
+
+// Nack returns an undelivered request, it still counts against the limits
+func (bq *BoundedQueue) Nack(reqParam model.RequestParam) error {
+
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+
+	return bq.q.Nack(reqParam)
+}
+
+// Peek returns request next in line without taking it out
+func (bq *BoundedQueue) Peek() (model.RequestParam, bool) {
+
+	return bq.q.Peek()
+}
+
+// Len returns number of queued and spilled requests
+func (bq *BoundedQueue) Len() int {
+
+	if bq.spill == nil {
+		return bq.q.Len()
+	}
+
+	return bq.q.Len() + bq.spill.Len()
+}
+
+// List returns queued requests followed by spilled ones
+func (bq *BoundedQueue) List() []model.RequestParam {
+
+	reqParams := bq.q.List()
+	if bq.spill != nil {
+		for _, reqParam := range bq.spill.List() {
+			reqParam.Seq |= spillSeqBit
+			reqParams = append(reqParams, reqParam)
+		}
+	}
+
+	return reqParams
+}
+
+// Remove takes a waiting or spilled request out of the queue
+func (bq *BoundedQueue) Remove(seq uint64) (model.RequestParam, bool) {
+
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+
+	if seq&spillSeqBit != 0 {
+		if bq.spill == nil {
+			return model.RequestParam{}, false
+		}
+		reqParam, ok := bq.spill.Remove(seq &^ spillSeqBit)
+		reqParam.Seq |= spillSeqBit
+		return reqParam, ok
+	}
+
+	reqParam, ok := bq.q.Remove(seq)
+	if ok {
+		bq.bytes -= BodySize(reqParam)
+		bq.refill()
+	}
+
+	return reqParam, ok
+}
+
+// Purge removes all waiting and spilled requests
+func (bq *BoundedQueue) Purge() int {
+
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+
+	purged := bq.q.Purge()
+	if bq.spill != nil {
+		purged += bq.spill.Purge()
+	}
+
+	bq.bytes = 0
+	for _, reqParam := range bq.q.List() {
+		bq.bytes += BodySize(reqParam)
+	}
+
+	return purged
+}
+
+// Ordered determines whether requests with ordering key are queued or spilled
+func (bq *BoundedQueue) Ordered(orderingKey string) bool {
+
+	return bq.q.Ordered(orderingKey) || (bq.spill != nil && bq.spill.Ordered(orderingKey))
+}
+
+// Notify returns a channel receiving when requests may have become ready
+func (bq *BoundedQueue) Notify() <-chan struct{} {
+
+	return bq.q.Notify()
+}
+
+// Close closes the queue and its overflow queue
+func (bq *BoundedQueue) Close() error {
+
+	if bq.spill != nil {
+		close(bq.stop)
+		bq.spill.Close()
+	}
+
+	return bq.q.Close()
+}
+
+// fits determines whether a request of size body bytes can be added within limits
+func (bq *BoundedQueue) fits(size int64) bool {
+
+	return (bq.maxItems <= 0 || bq.q.Len() < bq.maxItems) && (bq.maxBytes <= 0 || bq.bytes+size <= bq.maxBytes)
+}
+
+// dropOldest removes waiting requests, oldest first, until a request of size body bytes fits
+func (bq *BoundedQueue) dropOldest(size int64) bool {
+
+	reqParams := bq.q.List()
+	sort.Slice(reqParams, func(i, j int) bool { return reqParams[i].Seq < reqParams[j].Seq })
+
+	for _, reqParam := range reqParams {
+		if bq.fits(size) {
+			break
+		}
+		if dropped, ok := bq.q.Remove(reqParam.Seq); ok { // in flight ones cannot be removed
+			bq.bytes -= BodySize(dropped)
+			if bq.onDrop != nil {
+				bq.onDrop(dropped)
+			}
+		}
+	}
+
+	return bq.fits(size)
+}
+
+// refill moves ready spilled requests back into the queue while they fit
+func (bq *BoundedQueue) refill() {
+
+	if bq.spill == nil {
+		return
+	}
+
+	for {
+		next, ok := bq.spill.Peek()
+		if !ok || !bq.fits(BodySize(next)) {
+			return
+		}
+		reqParam, _ := bq.spill.Dequeue()
+		spillSeq := reqParam.Seq
+		reqParam.Seq = 0
+		if err := bq.q.Enqueue(reqParam); err != nil {
+			reqParam.Seq = spillSeq
+			bq.spill.Nack(reqParam)
+			return
+		}
+		bq.bytes += BodySize(reqParam)
+		reqParam.Seq = spillSeq
+		bq.spill.Ack(reqParam)
+	}
+}
+
+// watchSpill moves spilled requests back as they become due, until the queue is closed
+func (bq *BoundedQueue) watchSpill() {
+
+	for {
+		select {
+		case <-bq.stop:
+			return
+		case <-bq.spill.Notify():
+			bq.mu.Lock()
+			bq.refill()
+			bq.mu.Unlock()
+		}
+	}
+}
+
+// BodySize returns body bytes of a request, whether held in memory or spooled to disk
+func BodySize(reqParam model.RequestParam) int64 {
+
+	return int64(len(reqParam.BodyBuff)) + reqParam.BodySize
+}
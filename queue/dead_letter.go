@@ -0,0 +1,60 @@
+package queue
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
+)
+
+// Exhausted determines whether a buffered request has used up its delivery attempts
+// (Q_MAX_ATTEMPTS) or has been waiting for too long (Q_MAX_AGE). Zero limits are ignored.
+// Age of a delayed request is counted from its DeliverAt.
+func Exhausted(sqp *model.ServiceQProperties, reqParam model.RequestParam) bool {
+
+	if sqp.QMaxAttempts > 0 && reqParam.Attempts >= sqp.QMaxAttempts {
+		return true
+	}
+	since := reqParam.EnqueuedAt
+	if reqParam.DeliverAt.After(since) {
+		since = reqParam.DeliverAt
+	}
+	if sqp.QMaxAge > 0 && time.Since(since) >= time.Duration(sqp.QMaxAge)*time.Second {
+		return true
+	}
+
+	return false
+}
+
+// DeadLetter moves an in-flight request from q to dlq. The request is added to dlq
+// before it is acked on q, so a failure in between duplicates rather than loses it.
+func DeadLetter(q model.Queue, dlq model.Queue, reqParam model.RequestParam) error {
+
+	deadParam := reqParam
+	deadParam.Seq = 0
+	if err := dlq.Enqueue(deadParam); err != nil {
+		return err
+	}
+
+	return q.Ack(reqParam)
+}
+
+// Replay moves a dead-lettered request back to q with a fresh attempt count and age
+func Replay(dlq model.Queue, q model.Queue, seq uint64) (model.RequestParam, error) {
+
+	reqParam, ok := dlq.Remove(seq)
+	if !ok {
+		return reqParam, errors.New("not-found")
+	}
+
+	reqParam.Seq = 0
+	reqParam.Attempts = 0
+	reqParam.EnqueuedAt = time.Time{}
+	reqParam.RetryAt = time.Time{}
+	if err := q.Enqueue(reqParam); err != nil {
+		dlq.Enqueue(reqParam) // put it back rather than lose it
+		return reqParam, err
+	}
+
+	return reqParam, nil
+}
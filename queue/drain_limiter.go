@@ -0,0 +1,124 @@
+package queue
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// slowest pace as share of full rate, so that draining never stops
+const minDrainFactor = 0.05
+
+// time after which pace halved by failed replays is back to full, recovering linearly
+const drainRecovery = 10 * time.Second
+
+// DrainLimiter is a token bucket pacing replays of buffered requests, so that a just recovered
+// cluster is not flooded with the whole backlog at once. Once a replay succeeds after failed ones
+// (or first of all), the pace ramps up linearly from minDrainFactor to full rate over ramp. Apart
+// from the ramp, the pace is halved whenever a replay fails and recovers over drainRecovery.
+type DrainLimiter struct {
+	mu       sync.Mutex
+	rate     float64 // replays per second at full pace
+	ramp     time.Duration
+	rampFrom time.Time // start of current ramp, zero while replays fail
+	backoff  float64   // share of pace left by failed replays
+	factor   float64   // current share of full rate
+	tokens   float64
+	last     time.Time
+}
+
+// NewDrainLimiter returns a DrainLimiter allowing rate replays per second once ramped up
+func NewDrainLimiter(rate float64, ramp time.Duration) *DrainLimiter {
+
+	dl := &DrainLimiter{
+		rate:    rate,
+		ramp:    ramp,
+		backoff: 1,
+		last:    time.Now(),
+	}
+	dl.factor = dl.pace(dl.last)
+
+	return dl
+}
+
+// Wait blocks until a replay may be made or ctx is done
+func (dl *DrainLimiter) Wait(ctx context.Context) error {
+
+	for {
+		dl.mu.Lock()
+		dl.refill(time.Now())
+		if dl.tokens >= 1 {
+			dl.tokens--
+			dl.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - dl.tokens) / (dl.rate * dl.factor) * float64(time.Second))
+		dl.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Success starts the ramp on the first successful replay after failed ones
+func (dl *DrainLimiter) Success() {
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.rampFrom.IsZero() {
+		now := time.Now()
+		dl.refill(now)
+		dl.rampFrom = now
+		dl.factor = dl.pace(now)
+	}
+}
+
+// Failure slows the pace down after a failed replay, and holds the ramp until replays succeed again
+func (dl *DrainLimiter) Failure() {
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	now := time.Now()
+	dl.refill(now)
+	dl.rampFrom = time.Time{}
+	dl.backoff = math.Max(minDrainFactor, dl.backoff/2)
+	dl.factor = dl.pace(now)
+	dl.tokens = math.Min(dl.tokens, dl.burst())
+}
+
+// refill recovers pace and adds tokens earned since last refill
+func (dl *DrainLimiter) refill(now time.Time) {
+
+	elapsed := now.Sub(dl.last)
+	dl.last = now
+
+	dl.backoff = math.Min(1, dl.backoff+float64(elapsed)/float64(drainRecovery))
+	dl.factor = dl.pace(now)
+	dl.tokens = math.Min(dl.burst(), dl.tokens+elapsed.Seconds()*dl.rate*dl.factor)
+}
+
+// pace returns share of full rate at now, given ramp and failure backoff
+func (dl *DrainLimiter) pace(now time.Time) float64 {
+
+	factor := 1.0
+	if dl.ramp > 0 {
+		factor = minDrainFactor // held while replays fail
+		if !dl.rampFrom.IsZero() {
+			factor = math.Min(1, minDrainFactor+(1-minDrainFactor)*float64(now.Sub(dl.rampFrom))/float64(dl.ramp))
+		}
+	}
+
+	return math.Max(minDrainFactor, factor*dl.backoff)
+}
+
+// burst returns how many tokens may be saved up, 100ms worth of current pace but at least one
+func (dl *DrainLimiter) burst() float64 {
+
+	return math.Max(1, dl.rate*dl.factor/10)
+}
@@ -0,0 +1,194 @@
+package queue
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gptankit/serviceq/errorlog"
+	"github.com/gptankit/serviceq/model"
+	"github.com/gptankit/serviceq/wal"
+)
+
+var _ model.Queue = &FileQueue{}
+
+// FileQueue is a MemoryQueue backed by an on-disk write-ahead log. Every enqueued
+// request is logged before it becomes visible and stays in the log until acked,
+// so undelivered requests are restored when the queue is opened again.
+type FileQueue struct {
+	mu  sync.Mutex
+	mem *MemoryQueue
+	log *wal.Log
+}
+
+// NewFileQueue opens the write-ahead log in dir and restores undelivered requests in FIFO order
+func NewFileQueue(dir string, opts wal.Options) (*FileQueue, error) {
+
+	log, err := wal.Open(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fq := &FileQueue{
+		mem: NewMemoryQueue(),
+		log: log,
+	}
+
+	entries, err := log.Pending()
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	for _, entry := range entries {
+		var reqParam model.RequestParam
+		if err := json.Unmarshal(entry.Payload, &reqParam); err != nil {
+			log.Ack(entry.Seq) // unreadable entry can never be delivered
+			continue
+		}
+		reqParam.Seq = entry.Seq
+		fq.mem.push(reqParam)
+	}
+
+	return fq, nil
+}
+
+// Enqueue logs request and adds it to tail
+func (fq *FileQueue) Enqueue(reqParam model.RequestParam) error {
+
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	reqParam = stamp(reqParam)
+	reqParam.Seq = 0
+	payload, err := json.Marshal(reqParam)
+	if err != nil {
+		return err
+	}
+	if reqParam.Seq, err = fq.log.Append(payload); err != nil {
+		return err
+	}
+
+	fq.mem.mu.Lock()
+	fq.mem.push(reqParam)
+	fq.mem.mu.Unlock()
+
+	return nil
+}
+
+// SetWeights sets dequeue share of each priority lane, highest first
+func (fq *FileQueue) SetWeights(weights []int) {
+
+	fq.mem.SetWeights(weights)
+}
+
+// Compact enables compaction by CompactionKey, superseded requests are removed from the log
+func (fq *FileQueue) Compact(onSupersede func(model.RequestParam)) {
+
+	fq.mem.Compact(func(reqParam model.RequestParam) {
+		fq.log.Ack(reqParam.Seq)
+		if onSupersede != nil {
+			onSupersede(reqParam)
+		}
+	})
+}
+
+// Superseded returns number of requests superseded since compaction was enabled
+func (fq *FileQueue) Superseded() uint64 {
+
+	return fq.mem.Superseded()
+}
+
+// Dequeue takes request at head out for delivery
+func (fq *FileQueue) Dequeue() (model.RequestParam, bool) {
+
+	return fq.mem.Dequeue()
+}
+
+// Ack removes a delivered request from the log
+func (fq *FileQueue) Ack(reqParam model.RequestParam) error {
+
+	if err := fq.log.Ack(reqParam.Seq); err != nil {
+		return err
+	}
+
+	return fq.mem.Ack(reqParam)
+}
+
+// Nack returns an undelivered request to tail, logging updates made to it
+func (fq *FileQueue) Nack(reqParam model.RequestParam) error {
+
+	// request goes back to queue anyway, the log keeps its previous version (e.g. fewer attempts)
+	payload, err := json.Marshal(reqParam)
+	if err == nil {
+		err = fq.log.Update(reqParam.Seq, payload)
+	}
+	if err != nil {
+		go errorlog.LogGenericError("Could not log nack of request " + reqParam.Method + " " + reqParam.RequestURI + " -- " + err.Error())
+	}
+
+	return fq.mem.Nack(reqParam)
+}
+
+// Peek returns request at head without taking it out
+func (fq *FileQueue) Peek() (model.RequestParam, bool) {
+
+	return fq.mem.Peek()
+}
+
+// Len returns number of undelivered requests
+func (fq *FileQueue) Len() int {
+
+	return fq.mem.Len()
+}
+
+// List returns undelivered requests
+func (fq *FileQueue) List() []model.RequestParam {
+
+	return fq.mem.List()
+}
+
+// Remove takes a waiting request out of the queue and the log
+func (fq *FileQueue) Remove(seq uint64) (model.RequestParam, bool) {
+
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	reqParam, ok := fq.mem.Remove(seq)
+	if ok {
+		fq.log.Ack(seq)
+	}
+
+	return reqParam, ok
+}
+
+// Purge removes all waiting requests from the queue and the log
+func (fq *FileQueue) Purge() int {
+
+	purged := 0
+	for _, reqParam := range fq.mem.List() {
+		if _, ok := fq.Remove(reqParam.Seq); ok {
+			purged++
+		}
+	}
+
+	return purged
+}
+
+// Ordered determines whether requests with ordering key are waiting or in flight
+func (fq *FileQueue) Ordered(orderingKey string) bool {
+
+	return fq.mem.Ordered(orderingKey)
+}
+
+// Notify returns a channel receiving when requests may have become ready
+func (fq *FileQueue) Notify() <-chan struct{} {
+
+	return fq.mem.Notify()
+}
+
+// Close flushes and closes the write-ahead log
+func (fq *FileQueue) Close() error {
+
+	fq.mem.Close()
+
+	return fq.log.Close()
+}
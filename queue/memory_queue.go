@@ -0,0 +1,574 @@
+package queue
+
+import (
+	"container/heap"
+	"container/list"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
+)
+
+var _ model.Queue = &MemoryQueue{}
+
+const lanes = 3
+
+// default share of dequeues per priority lane, highest first
+var defaultWeights = [lanes]int{6, 3, 1}
+
+// MemoryQueue is an in-memory queue with one FIFO lane per priority class. Lanes are drained by
+// weighted round robin, highest first. Requests are lost when serviceq stops. Requests with a
+// future DeliverAt or RetryAt are held aside and join the tail of their lane once they become due. Requests
+// of a partition are skipped while another request of the same partition is in flight, and requests
+// with an OrderingKey until all earlier requests with that key are acked. Once compaction is
+// enabled, a request with a CompactionKey supersedes the waiting request with the same key.
+type MemoryQueue struct {
+	mu        sync.Mutex
+	waiting   [lanes]*list.List
+	weights   [lanes]int
+	credits   [lanes]int
+	index     map[uint64]*list.Element
+	scheduled schedule
+	inFlight  map[uint64]model.RequestParam
+	busy      map[string]bool     // partitions with a request in flight
+	ordered   map[string][]uint64 // seqs of undelivered requests per ordering key, oldest first
+	latest    map[string]uint64   // seq of newest undelivered request per compaction key
+	onCompact func(model.RequestParam)
+	compacted uint64 // number of superseded requests
+	nextSeq   uint64
+	ready     chan struct{} // notifies workers of requests that may have become ready
+	due       *time.Timer   // fires when earliest scheduled request becomes due
+}
+
+// NewMemoryQueue returns an empty MemoryQueue
+func NewMemoryQueue() *MemoryQueue {
+
+	mq := &MemoryQueue{
+		weights:  defaultWeights,
+		index:    make(map[uint64]*list.Element),
+		inFlight: make(map[uint64]model.RequestParam),
+		busy:     make(map[string]bool),
+		ordered:  make(map[string][]uint64),
+		latest:   make(map[string]uint64),
+		nextSeq:  1,
+		ready:    make(chan struct{}, 1),
+	}
+	for i := range mq.waiting {
+		mq.waiting[i] = list.New()
+	}
+
+	return mq
+}
+
+// SetWeights sets how many requests each priority lane (highest first) may
+// dequeue per round, before lower lanes get their turn. Non-positive weights are ignored.
+func (mq *MemoryQueue) SetWeights(weights []int) {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	for i := 0; i < lanes && i < len(weights); i++ {
+		if weights[i] > 0 {
+			mq.weights[i] = weights[i]
+		}
+	}
+	mq.credits = mq.weights
+}
+
+// Compact enables compaction by CompactionKey, also of requests already queued. onSupersede
+// is called, with queue locked, with every request that was superseded by a newer one.
+func (mq *MemoryQueue) Compact(onSupersede func(model.RequestParam)) {
+
+	reqParams := inOrder(mq.List())
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	mq.onCompact = onSupersede
+	for _, reqParam := range reqParams {
+		if _, ok := mq.inFlight[reqParam.Seq]; !ok {
+			mq.collapse(reqParam)
+		}
+	}
+}
+
+// Superseded returns number of requests superseded since compaction was enabled
+func (mq *MemoryQueue) Superseded() uint64 {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	return mq.compacted
+}
+
+// Enqueue adds request to tail and assigns it the next sequence number
+func (mq *MemoryQueue) Enqueue(reqParam model.RequestParam) error {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	reqParam.Seq = mq.nextSeq
+	mq.push(stamp(reqParam))
+
+	return nil
+}
+
+// Dequeue takes request at head of next lane out for delivery, it stays in flight until acked or nacked
+func (mq *MemoryQueue) Dequeue() (model.RequestParam, bool) {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	mq.promote(time.Now())
+	e, lane := mq.next()
+	if e == nil {
+		return model.RequestParam{}, false
+	}
+	mq.credits[lane]--
+
+	reqParam := mq.waiting[lane].Remove(e).(model.RequestParam)
+	delete(mq.index, reqParam.Seq)
+	mq.inFlight[reqParam.Seq] = reqParam
+	if reqParam.Partition != "" {
+		mq.busy[reqParam.Partition] = true
+	}
+	if mq.waitingLen() > 0 {
+		mq.notify() // wake another worker for the rest
+	}
+
+	return reqParam, true
+}
+
+// Ack forgets an in-flight request
+func (mq *MemoryQueue) Ack(reqParam model.RequestParam) error {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	if _, ok := mq.inFlight[reqParam.Seq]; !ok {
+		return errors.New("not-in-flight")
+	}
+	mq.unorder(mq.inFlight[reqParam.Seq])
+	mq.forget(mq.inFlight[reqParam.Seq])
+	mq.land(reqParam.Seq)
+
+	return nil
+}
+
+// Nack returns an in-flight request to tail, keeping updates made to it (e.g. attempts)
+func (mq *MemoryQueue) Nack(reqParam model.RequestParam) error {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	if _, ok := mq.inFlight[reqParam.Seq]; !ok {
+		return errors.New("not-in-flight")
+	}
+	mq.land(reqParam.Seq)
+	mq.push(reqParam)
+
+	return nil
+}
+
+// Peek returns request next in line without taking it out
+func (mq *MemoryQueue) Peek() (model.RequestParam, bool) {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	mq.promote(time.Now())
+	e, _ := mq.next()
+	if e == nil {
+		return model.RequestParam{}, false
+	}
+
+	return e.Value.(model.RequestParam), true
+}
+
+// Len returns number of waiting, scheduled and in-flight requests
+func (mq *MemoryQueue) Len() int {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	return mq.waitingLen() + len(mq.scheduled) + len(mq.inFlight)
+}
+
+// List returns in-flight requests ordered by Seq, followed by waiting requests in lane and queue
+// order and scheduled requests in order of DeliverAt (or RetryAt)
+func (mq *MemoryQueue) List() []model.RequestParam {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	mq.promote(time.Now())
+	reqParams := make([]model.RequestParam, 0, mq.waitingLen()+len(mq.scheduled)+len(mq.inFlight))
+	for _, reqParam := range mq.inFlight {
+		reqParams = append(reqParams, reqParam)
+	}
+	sort.Slice(reqParams, func(i, j int) bool { return reqParams[i].Seq < reqParams[j].Seq })
+
+	for _, waiting := range mq.waiting {
+		for e := waiting.Front(); e != nil; e = e.Next() {
+			reqParams = append(reqParams, e.Value.(model.RequestParam))
+		}
+	}
+
+	scheduled := append(schedule(nil), mq.scheduled...)
+	sort.Sort(scheduled)
+
+	return append(reqParams, scheduled...)
+}
+
+// Remove takes a waiting or scheduled request out of the queue
+func (mq *MemoryQueue) Remove(seq uint64) (model.RequestParam, bool) {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	reqParam, ok := mq.remove(seq)
+	if ok {
+		mq.unorder(reqParam)
+		mq.forget(reqParam)
+	}
+
+	return reqParam, ok
+}
+
+// Purge removes all waiting and scheduled requests and returns how many were removed
+func (mq *MemoryQueue) Purge() int {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	purged := mq.waitingLen() + len(mq.scheduled)
+	for _, waiting := range mq.waiting {
+		waiting.Init()
+	}
+	mq.index = make(map[uint64]*list.Element)
+	mq.scheduled = nil
+	mq.ordered = make(map[string][]uint64)
+	mq.latest = make(map[string]uint64)
+	for _, reqParam := range mq.inFlight {
+		mq.order(reqParam)
+		if reqParam.CompactionKey != "" && reqParam.Seq > mq.latest[reqParam.CompactionKey] {
+			mq.latest[reqParam.CompactionKey] = reqParam.Seq
+		}
+	}
+
+	return purged
+}
+
+// Ordered determines whether requests with ordering key are waiting or in flight
+func (mq *MemoryQueue) Ordered(orderingKey string) bool {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	return len(mq.ordered[orderingKey]) > 0
+}
+
+// Notify returns a channel receiving when requests may have become ready. Receivers
+// should dequeue until nothing is ready before waiting on it again.
+func (mq *MemoryQueue) Notify() <-chan struct{} {
+
+	return mq.ready
+}
+
+// Close stops waiting for scheduled requests
+func (mq *MemoryQueue) Close() error {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	if mq.due != nil {
+		mq.due.Stop()
+	}
+
+	return nil
+}
+
+// push adds request with an already assigned sequence number to tail of its lane, or
+// holds it aside until DeliverAt or RetryAt if that is in future
+func (mq *MemoryQueue) push(reqParam model.RequestParam) {
+
+	if reqParam.Seq >= mq.nextSeq {
+		mq.nextSeq = reqParam.Seq + 1
+	}
+	if !mq.collapse(reqParam) {
+		mq.unorder(reqParam) // superseded on its way back, e.g. on nack
+		return
+	}
+
+	mq.order(reqParam)
+
+	if readyAt(reqParam).After(time.Now()) {
+		heap.Push(&mq.scheduled, reqParam)
+		mq.arm()
+	} else {
+		mq.index[reqParam.Seq] = mq.waiting[laneOf(reqParam)].PushBack(reqParam)
+		mq.notify()
+	}
+}
+
+// promote moves scheduled requests that are due by now to tail of their lane
+func (mq *MemoryQueue) promote(now time.Time) {
+
+	for len(mq.scheduled) > 0 && !readyAt(mq.scheduled[0]).After(now) {
+		reqParam := heap.Pop(&mq.scheduled).(model.RequestParam)
+		mq.index[reqParam.Seq] = mq.waiting[laneOf(reqParam)].PushBack(reqParam)
+		mq.notify()
+	}
+}
+
+// arm sets timer to promote earliest scheduled request once due
+func (mq *MemoryQueue) arm() {
+
+	if len(mq.scheduled) == 0 {
+		return
+	}
+
+	wait := time.Until(readyAt(mq.scheduled[0]))
+	if mq.due == nil {
+		mq.due = time.AfterFunc(wait, mq.wake)
+	} else {
+		mq.due.Reset(wait)
+	}
+}
+
+// wake promotes scheduled requests that became due and waits for the next one
+func (mq *MemoryQueue) wake() {
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	mq.promote(time.Now())
+	mq.arm()
+}
+
+// notify signals a waiting worker, if none is signalled already
+func (mq *MemoryQueue) notify() {
+
+	select {
+	case mq.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next returns first ready request of highest lane with credits left, refilling credits once
+// every lane with ready requests has used up its share. Returns nil if no request is ready.
+func (mq *MemoryQueue) next() (*list.Element, int) {
+
+	var ready [lanes]*list.Element
+	found := false
+	for i, waiting := range mq.waiting {
+		ready[i] = mq.firstReady(waiting)
+		found = found || ready[i] != nil
+	}
+	if !found {
+		return nil, -1
+	}
+
+	for {
+		for i, e := range ready {
+			if e != nil && mq.credits[i] > 0 {
+				return e, i
+			}
+		}
+		mq.credits = mq.weights
+	}
+}
+
+// firstReady returns first request in lane whose partition is not busy and
+// which is oldest undelivered request of its ordering key
+func (mq *MemoryQueue) firstReady(waiting *list.List) *list.Element {
+
+	for e := waiting.Front(); e != nil; e = e.Next() {
+		reqParam := e.Value.(model.RequestParam)
+		if reqParam.Partition != "" && mq.busy[reqParam.Partition] {
+			continue
+		}
+		if reqParam.OrderingKey != "" && mq.ordered[reqParam.OrderingKey][0] != reqParam.Seq {
+			continue
+		}
+		return e
+	}
+
+	return nil
+}
+
+// order registers seq of a request with an ordering key, keeping seqs sorted. Already registered seqs are ignored.
+func (mq *MemoryQueue) order(reqParam model.RequestParam) {
+
+	if reqParam.OrderingKey == "" {
+		return
+	}
+
+	seqs := mq.ordered[reqParam.OrderingKey]
+	i := sort.Search(len(seqs), func(i int) bool { return seqs[i] >= reqParam.Seq })
+	if i < len(seqs) && seqs[i] == reqParam.Seq {
+		return
+	}
+	seqs = append(seqs, 0)
+	copy(seqs[i+1:], seqs[i:])
+	seqs[i] = reqParam.Seq
+	mq.ordered[reqParam.OrderingKey] = seqs
+}
+
+// unorder forgets seq of a request that left the queue, unblocking the next request with its ordering key
+func (mq *MemoryQueue) unorder(reqParam model.RequestParam) {
+
+	if reqParam.OrderingKey == "" {
+		return
+	}
+
+	seqs := mq.ordered[reqParam.OrderingKey]
+	for i, seq := range seqs {
+		if seq == reqParam.Seq {
+			seqs = append(seqs[:i], seqs[i+1:]...)
+			break
+		}
+	}
+	if len(seqs) == 0 {
+		delete(mq.ordered, reqParam.OrderingKey)
+	} else {
+		mq.ordered[reqParam.OrderingKey] = seqs
+	}
+}
+
+// collapse supersedes the waiting request with same compaction key if it is older than reqParam.
+// It returns false if reqParam is itself superseded by a newer request.
+func (mq *MemoryQueue) collapse(reqParam model.RequestParam) bool {
+
+	if mq.onCompact == nil || reqParam.CompactionKey == "" {
+		return true
+	}
+
+	latest, ok := mq.latest[reqParam.CompactionKey]
+	if ok && latest > reqParam.Seq {
+		mq.compacted++
+		mq.onCompact(reqParam)
+		return false
+	}
+	if ok && latest < reqParam.Seq {
+		if older, removed := mq.remove(latest); removed { // in flight ones are delivered anyway
+			mq.unorder(older)
+			mq.compacted++
+			mq.onCompact(older)
+		}
+	}
+	mq.latest[reqParam.CompactionKey] = reqParam.Seq
+
+	return true
+}
+
+// forget drops compaction key of a request that left the queue, unless a newer request took it over
+func (mq *MemoryQueue) forget(reqParam model.RequestParam) {
+
+	if reqParam.CompactionKey != "" && mq.latest[reqParam.CompactionKey] == reqParam.Seq {
+		delete(mq.latest, reqParam.CompactionKey)
+	}
+}
+
+// land takes a request out of flight, freeing its partition
+func (mq *MemoryQueue) land(seq uint64) {
+
+	if partition := mq.inFlight[seq].Partition; partition != "" {
+		delete(mq.busy, partition)
+	}
+	delete(mq.inFlight, seq)
+	if mq.waitingLen() > 0 {
+		mq.notify() // requests of partition or ordering key may be ready now
+	}
+}
+
+// waitingLen returns number of waiting requests across lanes
+func (mq *MemoryQueue) waitingLen() int {
+
+	n := 0
+	for _, waiting := range mq.waiting {
+		n += waiting.Len()
+	}
+
+	return n
+}
+
+// remove takes a waiting or scheduled request out of the queue
+func (mq *MemoryQueue) remove(seq uint64) (model.RequestParam, bool) {
+
+	if e, ok := mq.index[seq]; ok {
+		delete(mq.index, seq)
+		reqParam := e.Value.(model.RequestParam)
+		return mq.waiting[laneOf(reqParam)].Remove(e).(model.RequestParam), true
+	}
+
+	for i, reqParam := range mq.scheduled {
+		if reqParam.Seq == seq {
+			heap.Remove(&mq.scheduled, i)
+			return reqParam, true
+		}
+	}
+
+	return model.RequestParam{}, false
+}
+
+// stamp sets the time a request enters the queue, if not set already
+func stamp(reqParam model.RequestParam) model.RequestParam {
+
+	if reqParam.EnqueuedAt.IsZero() {
+		reqParam.EnqueuedAt = time.Now()
+	}
+
+	return reqParam
+}
+
+// laneOf returns index of lane for priority class of request
+func laneOf(reqParam model.RequestParam) int {
+
+	for i, priority := range model.Priorities {
+		if reqParam.Priority == priority {
+			return i
+		}
+	}
+
+	return 1 // normal
+}
+
+// readyAt returns time from which request may be delivered, the later of DeliverAt and RetryAt
+func readyAt(reqParam model.RequestParam) time.Time {
+
+	if reqParam.RetryAt.After(reqParam.DeliverAt) {
+		return reqParam.RetryAt
+	}
+
+	return reqParam.DeliverAt
+}
+
+// schedule is a min-heap of requests ordered by readyAt, then Seq
+type schedule []model.RequestParam
+
+func (s schedule) Len() int { return len(s) }
+
+func (s schedule) Less(i, j int) bool {
+
+	if readyAt(s[i]).Equal(readyAt(s[j])) {
+		return s[i].Seq < s[j].Seq
+	}
+
+	return readyAt(s[i]).Before(readyAt(s[j]))
+}
+
+func (s schedule) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s *schedule) Push(x interface{}) { *s = append(*s, x.(model.RequestParam)) }
+
+func (s *schedule) Pop() interface{} {
+
+	old := *s
+	reqParam := old[len(old)-1]
+	*s = old[:len(old)-1]
+
+	return reqParam
+}
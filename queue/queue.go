@@ -0,0 +1,70 @@
+// Package queue provides the buffered request stores selectable through Q_BACKEND.
+package queue
+
+import (
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
+	"github.com/gptankit/serviceq/wal"
+)
+
+const (
+	BACKEND_MEMORY = "memory"
+	BACKEND_FILE   = "file"
+
+	deadLetterDir = "dead-letter"
+)
+
+// Compactor is implemented by queues able to collapse requests sharing a CompactionKey (Q_COMPACT_BY)
+type Compactor interface {
+	Compact(onSupersede func(model.RequestParam))
+	Superseded() uint64
+}
+
+var (
+	_ Compactor = &MemoryQueue{}
+	_ Compactor = &FileQueue{}
+	_ Compactor = &BoundedQueue{}
+)
+
+// New returns the queue backend configured in sq.properties
+func New(sqp *model.ServiceQProperties) (model.Queue, error) {
+
+	return newBackend(sqp, sqp.QWALDir)
+}
+
+// NewDeadLetter returns the dead-letter store for the queue backend configured in sq.properties
+func NewDeadLetter(sqp *model.ServiceQProperties) (model.Queue, error) {
+
+	return newBackend(sqp, filepath.Join(sqp.QWALDir, deadLetterDir))
+}
+
+// newBackend creates a queue of configured backend, file backend keeps its log in dir
+func newBackend(sqp *model.ServiceQProperties, dir string) (model.Queue, error) {
+
+	switch sqp.QBackend {
+	case BACKEND_MEMORY, "":
+		mq := NewMemoryQueue()
+		mq.SetWeights(sqp.QPriorityWeights)
+		return mq, nil
+	case BACKEND_FILE:
+		fsync, err := wal.ParseFsyncPolicy(sqp.QWALFsync)
+		if err != nil {
+			return nil, err
+		}
+		fq, err := NewFileQueue(dir, wal.Options{
+			SegmentSize:   sqp.QWALSegmentSize << 20,
+			Fsync:         fsync,
+			FsyncInterval: time.Duration(sqp.QWALFsyncInterval) * time.Millisecond,
+		})
+		if err != nil {
+			return nil, err
+		}
+		fq.SetWeights(sqp.QPriorityWeights)
+		return fq, nil
+	default:
+		return nil, errors.New("invalid-queue-backend")
+	}
+}
@@ -0,0 +1,449 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
+	"github.com/gptankit/serviceq/wal"
+)
+
+func newRequest(uri string) model.RequestParam {
+
+	return model.RequestParam{Protocol: "HTTP/1.1", Method: "POST", RequestURI: uri}
+}
+
+func TestFIFOWithNack(t *testing.T) {
+
+	fq, err := NewFileQueue(t.TempDir(), wal.Options{Fsync: wal.FsyncNever})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fq.Close()
+
+	for _, q := range []model.Queue{NewMemoryQueue(), fq} {
+		q.Enqueue(newRequest("/r1"))
+		q.Enqueue(newRequest("/r2"))
+
+		if head, _ := q.Peek(); head.RequestURI != "/r1" {
+			t.Errorf("expected /r1 at head, got %s\n", head.RequestURI)
+		}
+
+		r1, _ := q.Dequeue()
+		q.Nack(r1)
+		r2, _ := q.Dequeue()
+		q.Ack(r2)
+		if r2.RequestURI != "/r2" {
+			t.Errorf("nacked request not moved to tail, got %s\n", r2.RequestURI)
+		}
+
+		if q.Len() != 1 {
+			t.Errorf("expected 1 undelivered request, got %d\n", q.Len())
+		}
+	}
+}
+
+func TestFileQueueRestore(t *testing.T) {
+
+	dir := t.TempDir()
+
+	fq, _ := NewFileQueue(dir, wal.Options{Fsync: wal.FsyncAlways})
+	fq.Enqueue(newRequest("/r1"))
+	fq.Enqueue(newRequest("/r2"))
+	fq.Enqueue(newRequest("/r3"))
+	r1, _ := fq.Dequeue()
+	fq.Ack(r1)
+	fq.Dequeue() // in flight during shutdown
+	fq.Close()
+
+	fq, err := NewFileQueue(dir, wal.Options{Fsync: wal.FsyncAlways})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fq.Close()
+
+	if fq.Len() != 2 {
+		t.Fatalf("expected 2 restored requests, got %d\n", fq.Len())
+	}
+	for _, uri := range []string{"/r2", "/r3"} {
+		if reqParam, _ := fq.Dequeue(); reqParam.RequestURI != uri {
+			t.Errorf("expected %s, got %s\n", uri, reqParam.RequestURI)
+		}
+	}
+}
+
+func TestFileQueueNackWithoutLog(t *testing.T) {
+
+	fq, err := NewFileQueue(t.TempDir(), wal.Options{Fsync: wal.FsyncAlways})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fq.Enqueue(newRequest("/r1"))
+	r1, _ := fq.Dequeue()
+
+	fq.log.Close() // log update fails from here
+	fq.Nack(r1)
+
+	if reqParam, ok := fq.Dequeue(); !ok || reqParam.RequestURI != "/r1" {
+		t.Errorf("expected nacked request redelivered despite log failure, got %v\n", ok)
+	}
+}
+
+func TestDeadLetterAndReplay(t *testing.T) {
+
+	sqp := &model.ServiceQProperties{QMaxAttempts: 2}
+	q, dlq := NewMemoryQueue(), NewMemoryQueue()
+
+	q.Enqueue(newRequest("/poison"))
+	reqParam, _ := q.Dequeue()
+	reqParam.Attempts = 2
+
+	if !Exhausted(sqp, reqParam) {
+		t.Fatalf("request with %d attempts not exhausted, max=%d\n", reqParam.Attempts, sqp.QMaxAttempts)
+	}
+
+	DeadLetter(q, dlq, reqParam)
+	if q.Len() != 0 || dlq.Len() != 1 {
+		t.Fatalf("request not moved to dead-letter queue, q=%d, dlq=%d\n", q.Len(), dlq.Len())
+	}
+
+	dead, _ := dlq.Peek()
+	if dead.Attempts != 2 || !dead.EnqueuedAt.Equal(reqParam.EnqueuedAt) {
+		t.Errorf("dead-lettered request lost its attempts or age\n")
+	}
+
+	replayed, err := Replay(dlq, q, dead.Seq)
+	if err != nil || q.Len() != 1 || dlq.Len() != 0 || replayed.Attempts != 0 {
+		t.Errorf("dead-lettered request not replayed, q=%d, dlq=%d\n", q.Len(), dlq.Len())
+	}
+
+	sqp = &model.ServiceQProperties{QMaxAge: 1}
+	if Exhausted(sqp, model.RequestParam{EnqueuedAt: time.Now()}) || !Exhausted(sqp, model.RequestParam{EnqueuedAt: time.Now().Add(-2 * time.Second)}) {
+		t.Errorf("request age not evaluated against Q_MAX_AGE\n")
+	}
+}
+
+func TestDelayedDelivery(t *testing.T) {
+
+	q := NewMemoryQueue()
+	q.Enqueue(model.RequestParam{RequestURI: "/later", DeliverAt: time.Now().Add(50 * time.Millisecond)})
+	q.Enqueue(model.RequestParam{RequestURI: "/now"})
+
+	if reqParam, ok := q.Dequeue(); !ok || reqParam.RequestURI != "/now" {
+		t.Errorf("expected due request first, got %v\n", reqParam)
+	}
+	if reqParam, ok := q.Dequeue(); ok {
+		t.Errorf("delayed request dequeued before due, got %v\n", reqParam)
+	}
+	if q.Len() != 2 || len(q.List()) != 2 {
+		t.Errorf("delayed request not counted, len=%d\n", q.Len())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if reqParam, ok := q.Dequeue(); !ok || reqParam.RequestURI != "/later" {
+		t.Errorf("delayed request not dequeued once due, got %v\n", reqParam)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+
+	q := NewMemoryQueue()
+	q.Enqueue(model.RequestParam{RequestURI: "/failing", Partition: "/failing"})
+	q.Enqueue(model.RequestParam{RequestURI: "/healthy", Partition: "/healthy"})
+
+	failing, _ := q.Dequeue()
+	failing.RetryAt = time.Now().Add(50 * time.Millisecond)
+	q.Nack(failing)
+
+	if reqParam, ok := q.Dequeue(); !ok || reqParam.RequestURI != "/healthy" {
+		t.Errorf("expected other request while failed one backs off, got %v\n", reqParam)
+	}
+	if reqParam, ok := q.Dequeue(); ok {
+		t.Errorf("failed request dequeued before its retry time, got %v\n", reqParam)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if reqParam, ok := q.Dequeue(); !ok || reqParam.RequestURI != "/failing" {
+		t.Errorf("failed request not dequeued once retry time passed, got %v\n", reqParam)
+	}
+}
+
+func TestPriorityLanes(t *testing.T) {
+
+	q := NewMemoryQueue()
+	q.SetWeights([]int{2, 1, 1})
+	for i := 0; i < 3; i++ {
+		q.Enqueue(model.RequestParam{RequestURI: "/bulk", Priority: model.PRIORITY_LOW})
+		q.Enqueue(model.RequestParam{RequestURI: "/payments", Priority: model.PRIORITY_HIGH})
+	}
+
+	order := ""
+	for reqParam, ok := q.Dequeue(); ok; reqParam, ok = q.Dequeue() {
+		order += reqParam.Priority[:1]
+		q.Ack(reqParam)
+	}
+	if order != "hhlhll" {
+		t.Errorf("expected weighted order hhlhll, got %s\n", order)
+	}
+}
+
+func TestPartitions(t *testing.T) {
+
+	q := NewMemoryQueue()
+	q.Enqueue(model.RequestParam{RequestURI: "/reports", Partition: "/reports"})
+	q.Enqueue(model.RequestParam{RequestURI: "/reports", Partition: "/reports"})
+	q.Enqueue(model.RequestParam{RequestURI: "/orders", Partition: "/orders"})
+
+	reports, _ := q.Dequeue()
+	if reqParam, ok := q.Dequeue(); !ok || reqParam.Partition != "/orders" {
+		t.Errorf("expected busy partition to be skipped, got %v\n", reqParam)
+	}
+	if reqParam, ok := q.Dequeue(); ok {
+		t.Errorf("expected no ready request while partitions are busy, got %v\n", reqParam)
+	}
+
+	q.Nack(reports)
+	if reqParam, ok := q.Dequeue(); !ok || reqParam.Partition != "/reports" {
+		t.Errorf("expected partition to be ready once nacked, got %v\n", reqParam)
+	}
+}
+
+func TestOrderingKey(t *testing.T) {
+
+	q := NewMemoryQueue()
+	q.Enqueue(model.RequestParam{RequestURI: "/accounts/1/debit", OrderingKey: "acc-1"})
+	q.Enqueue(model.RequestParam{RequestURI: "/accounts/1/credit", OrderingKey: "acc-1", Priority: model.PRIORITY_HIGH})
+	q.Enqueue(model.RequestParam{RequestURI: "/accounts/2/debit", OrderingKey: "acc-2"})
+
+	first, ok := q.Dequeue()
+	if !ok || first.RequestURI != "/accounts/1/debit" {
+		t.Errorf("expected oldest request of key first despite priority, got %v\n", first)
+	}
+	if reqParam, ok := q.Dequeue(); !ok || reqParam.OrderingKey != "acc-2" {
+		t.Errorf("expected other key to proceed, got %v\n", reqParam)
+	} else {
+		q.Ack(reqParam)
+	}
+
+	q.Nack(first)
+	if reqParam, _ := q.Dequeue(); reqParam.Seq != first.Seq {
+		t.Errorf("expected nacked head to stay at head of its key, got %v\n", reqParam)
+	}
+
+	q.Ack(first)
+	if reqParam, ok := q.Dequeue(); !ok || reqParam.RequestURI != "/accounts/1/credit" {
+		t.Errorf("expected next request of key once head is acked, got %v\n", reqParam)
+	}
+	if !q.Ordered("acc-1") || q.Ordered("acc-2") {
+		t.Errorf("ordering keys not tracked\n")
+	}
+}
+
+func TestDrainLimiter(t *testing.T) {
+
+	dl := NewDrainLimiter(100, 0)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		dl.Wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected replays to be paced at 100/s, 5 took %v\n", elapsed)
+	}
+
+	// failures slow down replays without ramp
+	count := func(dl *DrainLimiter) int {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		n := 0
+		for dl.Wait(ctx) == nil {
+			n++
+		}
+		return n
+	}
+	full, failing := NewDrainLimiter(100, 0), NewDrainLimiter(100, 0)
+	for i := 0; i < 3; i++ {
+		failing.Failure()
+	}
+	if fullN, failingN := count(full), count(failing); failingN*2 > fullN {
+		t.Errorf("expected failures to slow replays down, %d replays at full pace, %d after failures\n", fullN, failingN)
+	}
+
+	dl = NewDrainLimiter(100, time.Minute)
+	if dl.factor != minDrainFactor {
+		t.Errorf("expected pace to start at %v, got %v\n", minDrainFactor, dl.factor)
+	}
+	dl.Success()
+	dl.rampFrom = dl.rampFrom.Add(-time.Minute) // ramped up
+	dl.refill(time.Now())
+	if dl.factor != 1 {
+		t.Errorf("expected full pace after ramp, got %v\n", dl.factor)
+	}
+	dl.Failure()
+	if dl.factor > minDrainFactor+0.01 {
+		t.Errorf("expected pace held low while replays fail, got %v\n", dl.factor)
+	}
+	dl.Success()
+	if !dl.rampFrom.After(time.Now().Add(-time.Second)) {
+		t.Errorf("expected ramp to restart on success after failure\n")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := NewDrainLimiter(0.001, 0).Wait(ctx); err == nil {
+		t.Errorf("expected wait to end with ctx\n")
+	}
+}
+
+func TestNotify(t *testing.T) {
+
+	q := NewMemoryQueue()
+	defer q.Close()
+
+	q.Enqueue(model.RequestParam{RequestURI: "/later", DeliverAt: time.Now().Add(50 * time.Millisecond)})
+	select {
+	case <-q.Notify():
+		t.Errorf("notified before delayed request became due\n")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	select {
+	case <-q.Notify():
+		if _, ok := q.Dequeue(); !ok {
+			t.Errorf("notified but no request ready\n")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("not notified once delayed request became due\n")
+	}
+}
+
+func TestBoundedQueue(t *testing.T) {
+
+	sqp := &model.ServiceQProperties{QMaxItems: 2, QMaxBytes: 10, QOverflow: OVERFLOW_REJECT}
+	bq, _ := NewBounded(sqp, NewMemoryQueue(), nil)
+	bq.Enqueue(model.RequestParam{BodyBuff: []byte("12345")})
+	if err := bq.Enqueue(model.RequestParam{BodyBuff: []byte("123456")}); err != ErrQueueFull {
+		t.Errorf("expected request exceeding byte limit to be rejected, got %v\n", err)
+	}
+	if err := bq.Enqueue(model.RequestParam{BodyFile: "/tmp/body", BodySize: 6}); err != ErrQueueFull {
+		t.Errorf("expected spooled request exceeding byte limit to be rejected, got %v\n", err)
+	}
+	bq.Enqueue(model.RequestParam{BodyBuff: []byte("1")})
+	if err := bq.Enqueue(model.RequestParam{}); err != ErrQueueFull {
+		t.Errorf("expected request exceeding item limit to be rejected, got %v\n", err)
+	}
+
+	dropped := 0
+	sqp.QOverflow = OVERFLOW_DROP_OLDEST
+	bq, _ = NewBounded(sqp, NewMemoryQueue(), func(model.RequestParam) { dropped++ })
+	bq.Enqueue(newRequest("/1"))
+	bq.Enqueue(newRequest("/2"))
+	bq.Enqueue(newRequest("/3"))
+	if reqParam, _ := bq.Peek(); dropped != 1 || bq.Len() != 2 || reqParam.RequestURI != "/2" {
+		t.Errorf("expected oldest request to be dropped, dropped=%d, head=%s\n", dropped, reqParam.RequestURI)
+	}
+
+	sqp = &model.ServiceQProperties{QMaxItems: 1, QOverflow: OVERFLOW_SPILL, QWALDir: t.TempDir(), QWALSegmentSize: 1, QWALFsync: "never"}
+	bq, err := NewBounded(sqp, NewMemoryQueue(), nil)
+	if err != nil {
+		t.Fatalf("could not open spill queue -- %v\n", err)
+	}
+	defer bq.Close()
+	bq.Enqueue(newRequest("/1"))
+	bq.Enqueue(newRequest("/2"))
+	if bq.Len() != 2 || len(bq.List()) != 2 {
+		t.Errorf("expected overflow to be spilled, len=%d\n", bq.Len())
+	}
+	for _, uri := range []string{"/1", "/2"} {
+		reqParam, ok := bq.Dequeue()
+		if !ok || reqParam.RequestURI != uri {
+			t.Errorf("expected %s, got %v\n", uri, reqParam)
+		}
+		bq.Ack(reqParam)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+
+	path := t.TempDir() + "/queue.snapshot"
+
+	q, dlq := NewMemoryQueue(), NewMemoryQueue()
+	for _, uri := range []string{"/a", "/b", "/c"} {
+		q.Enqueue(newRequest(uri))
+	}
+	dead := newRequest("/dead")
+	dead.Attempts = 5
+	dlq.Enqueue(dead)
+
+	if err := SaveSnapshot(path, q, dlq); err != nil {
+		t.Fatal(err)
+	}
+
+	rq, rdlq := NewMemoryQueue(), NewMemoryQueue()
+	if restored, err := RestoreSnapshot(path, rq, rdlq); err != nil || restored != 4 {
+		t.Fatalf("Expected 4 restored requests, got %d (%v)", restored, err)
+	}
+	for _, uri := range []string{"/a", "/b", "/c"} {
+		if reqParam, _ := rq.Dequeue(); reqParam.RequestURI != uri {
+			t.Errorf("Expected %s, got %s", uri, reqParam.RequestURI)
+		}
+	}
+	if reqParam, _ := rdlq.Peek(); reqParam.RequestURI != "/dead" || reqParam.Attempts != 5 {
+		t.Errorf("Dead-lettered request not restored")
+	}
+
+	// snapshot is consumed on restore
+	if restored, _ := RestoreSnapshot(path, NewMemoryQueue(), NewMemoryQueue()); restored != 0 {
+		t.Errorf("Snapshot restored twice")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+
+	fq, err := NewFileQueue(t.TempDir(), wal.Options{Fsync: wal.FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fq.Close()
+
+	var superseded []string
+	fq.Compact(func(reqParam model.RequestParam) {
+		superseded = append(superseded, reqParam.RequestURI+"#"+reqParam.Id)
+	})
+
+	put := func(uri string, id string) model.RequestParam {
+		reqParam := newRequest(uri)
+		reqParam.Method, reqParam.Id, reqParam.CompactionKey = "PUT", id, "PUT "+uri
+		return reqParam
+	}
+	fq.Enqueue(put("/items/1", "v1"))
+	fq.Enqueue(put("/items/2", "v1"))
+	fq.Enqueue(put("/items/1", "v2"))
+	fq.Enqueue(newRequest("/items"))
+
+	if fq.Len() != 3 || fq.Superseded() != 1 || len(superseded) != 1 || superseded[0] != "/items/1#v1" {
+		t.Fatalf("Expected /items/1#v1 superseded, got %v", superseded)
+	}
+
+	// request in flight is not superseded, but is dropped if a newer one arrives before it is nacked
+	first, _ := fq.Dequeue()
+	if first.RequestURI != "/items/2" {
+		t.Fatalf("Expected /items/2, got %s", first.RequestURI)
+	}
+	fq.Enqueue(put("/items/2", "v2"))
+	fq.Nack(first)
+	if fq.Superseded() != 2 || superseded[1] != "/items/2#v1" {
+		t.Errorf("Expected nacked /items/2#v1 superseded, got %v", superseded)
+	}
+
+	var ids []string
+	for reqParam, ok := fq.Dequeue(); ok; reqParam, ok = fq.Dequeue() {
+		ids = append(ids, reqParam.RequestURI+"#"+reqParam.Id)
+		fq.Ack(reqParam)
+	}
+	if len(ids) != 3 || ids[0] != "/items/1#v2" || ids[2] != "/items/2#v2" {
+		t.Errorf("Expected latest version of each resource, got %v", ids)
+	}
+}
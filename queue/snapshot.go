@@ -0,0 +1,94 @@
+package queue
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gptankit/serviceq/model"
+)
+
+// snapshot is the on-disk form of the memory backend queues, written on shutdown (Q_SNAPSHOT_FILE)
+type snapshot struct {
+	Queue      []model.RequestParam `json:"queue"`
+	DeadLetter []model.RequestParam `json:"dead_letter"`
+}
+
+// SaveSnapshot writes requests left in q and dlq to file at path, so that they survive a restart
+// of the memory backend. The file is replaced atomically.
+func SaveSnapshot(path string, q model.Queue, dlq model.Queue) error {
+
+	snap := snapshot{Queue: inOrder(q.List()), DeadLetter: inOrder(dlq.List())}
+	if len(snap.Queue) == 0 && len(snap.DeadLetter) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// RestoreSnapshot adds requests saved at path back to q and dlq in their original order and removes
+// the file. It returns number of restored requests, a missing file restores nothing.
+func RestoreSnapshot(path string, q model.Queue, dlq model.Queue) (int, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	for _, store := range []struct {
+		q         model.Queue
+		reqParams []model.RequestParam
+	}{{q, snap.Queue}, {dlq, snap.DeadLetter}} {
+		for _, reqParam := range store.reqParams {
+			reqParam.Seq = 0
+			if err := store.q.Enqueue(reqParam); err != nil {
+				return restored, err
+			}
+			restored++
+		}
+	}
+
+	return restored, os.Remove(path)
+}
+
+// inOrder sorts requests by arrival
+func inOrder(reqParams []model.RequestParam) []model.RequestParam {
+
+	sort.Slice(reqParams, func(i, j int) bool { return reqParams[i].Seq < reqParams[j].Seq })
+
+	return reqParams
+}
@@ -0,0 +1,128 @@
+package result
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
+)
+
+const STATE_IN_PROGRESS = "in-progress"
+
+// KeyEntry is the request first seen with an idempotency key
+type KeyEntry struct {
+	RequestId   string
+	Fingerprint string // method and uri the key was first used with
+	Result      Result
+	SeenAt      time.Time
+}
+
+// KeyStore maps client idempotency keys to the first request seen with them. Entries
+// expire window after they were first seen, except for requests still in progress or queued.
+type KeyStore struct {
+	mu        sync.Mutex
+	entries   map[string]KeyEntry
+	window    time.Duration
+	lastSweep time.Time
+}
+
+// NewKeyStore returns an empty KeyStore deduplicating requests within window
+func NewKeyStore(window time.Duration) *KeyStore {
+
+	return &KeyStore{
+		entries:   make(map[string]KeyEntry),
+		window:    window,
+		lastSweep: time.Now(),
+	}
+}
+
+// Claim registers key for request id as in progress. If key is already registered
+// within window, the existing entry is returned and claimed is false.
+func (ks *KeyStore) Claim(key string, fingerprint string, id string) (entry KeyEntry, claimed bool) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := time.Now()
+	ks.sweep(now)
+
+	if entry, ok := ks.entries[key]; ok && !ks.expired(entry, now) {
+		return entry, false
+	}
+
+	entry = KeyEntry{
+		RequestId:   id,
+		Fingerprint: fingerprint,
+		Result:      Result{State: STATE_IN_PROGRESS, UpdatedAt: now},
+		SeenAt:      now,
+	}
+	ks.entries[key] = entry
+
+	return entry, true
+}
+
+// Set records state (and response, once delivered) of the request holding key
+func (ks *KeyStore) Set(key string, id string, state string, resParam model.ResponseParam) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if entry, ok := ks.entries[key]; ok && entry.RequestId == id {
+		entry.Result = Result{State: state, Response: resParam, UpdatedAt: time.Now()}
+		ks.entries[key] = entry
+	}
+}
+
+// Release forgets key held by request id, so that a retry with the same key is processed again
+func (ks *KeyStore) Release(key string, id string) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if entry, ok := ks.entries[key]; ok && entry.RequestId == id {
+		delete(ks.entries, key)
+	}
+}
+
+// Holder returns id of the request holding key
+func (ks *KeyStore) Holder(key string) (string, bool) {
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	entry, ok := ks.entries[key]
+	if !ok || ks.expired(entry, time.Now()) {
+		return "", false
+	}
+
+	return entry.RequestId, true
+}
+
+// Fingerprint returns what a request is identified by besides its idempotency key
+func Fingerprint(reqParam model.RequestParam) string {
+
+	return reqParam.Method + " " + reqParam.RequestURI
+}
+
+// sweep removes expired entries at most once per window
+func (ks *KeyStore) sweep(now time.Time) {
+
+	if now.Sub(ks.lastSweep) < ks.window {
+		return
+	}
+
+	for k, v := range ks.entries {
+		if ks.expired(v, now) {
+			delete(ks.entries, k)
+		}
+	}
+	ks.lastSweep = now
+}
+
+// expired determines whether an entry has outlived window
+func (ks *KeyStore) expired(entry KeyEntry, now time.Time) bool {
+
+	pending := entry.Result.State == STATE_IN_PROGRESS || entry.Result.State == STATE_QUEUED
+
+	return !pending && now.Sub(entry.SeenAt) >= ks.window
+}
@@ -0,0 +1,119 @@
+// Package result keeps the outcome of buffered requests, so that clients accepted
+// asynchronously can poll for it and repeated requests with an idempotency key can be answered.
+package result
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
+)
+
+const (
+	STATE_QUEUED        = "queued"
+	STATE_DELIVERED     = "delivered"
+	STATE_DEAD_LETTERED = "dead-lettered"
+	STATE_SUPERSEDED    = "superseded"
+	STATE_REMOVED       = "removed"
+)
+
+// Result is the state of a buffered request and, once delivered, the upstream response
+type Result struct {
+	State     string
+	Response  model.ResponseParam
+	UpdatedAt time.Time
+}
+
+// Store maps request ids to results. Final results (delivered, dead-lettered, superseded or removed)
+// expire after ttl, queued ones are kept until they reach a final state.
+type Store struct {
+	mu        sync.Mutex
+	results   map[string]Result
+	ttl       time.Duration
+	lastSweep time.Time
+}
+
+// NewStore returns an empty Store expiring final results after ttl
+func NewStore(ttl time.Duration) *Store {
+
+	return &Store{
+		results:   make(map[string]Result),
+		ttl:       ttl,
+		lastSweep: time.Now(),
+	}
+}
+
+// Queued records that request id is waiting in queue
+func (rs *Store) Queued(id string) {
+
+	rs.set(id, Result{State: STATE_QUEUED})
+}
+
+// Delivered records the upstream response of request id
+func (rs *Store) Delivered(id string, resParam model.ResponseParam) {
+
+	rs.set(id, Result{State: STATE_DELIVERED, Response: resParam})
+}
+
+// DeadLettered records that request id will not be delivered
+func (rs *Store) DeadLettered(id string) {
+
+	rs.set(id, Result{State: STATE_DEAD_LETTERED})
+}
+
+// Superseded records that request id was replaced in queue by a newer request for the same resource
+func (rs *Store) Superseded(id string) {
+
+	rs.set(id, Result{State: STATE_SUPERSEDED})
+}
+
+// Removed records that request id was deleted from queue through the admin api
+func (rs *Store) Removed(id string) {
+
+	rs.set(id, Result{State: STATE_REMOVED})
+}
+
+// Get returns result of request id
+func (rs *Store) Get(id string) (Result, bool) {
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	res, ok := rs.results[id]
+	if ok && rs.expired(res, time.Now()) {
+		delete(rs.results, id)
+		return Result{}, false
+	}
+
+	return res, ok
+}
+
+// set stores result of request id, sweeping expired results at most once per ttl
+func (rs *Store) set(id string, res Result) {
+
+	if id == "" {
+		return
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	now := time.Now()
+	res.UpdatedAt = now
+	rs.results[id] = res
+
+	if now.Sub(rs.lastSweep) >= rs.ttl {
+		for k, v := range rs.results {
+			if rs.expired(v, now) {
+				delete(rs.results, k)
+			}
+		}
+		rs.lastSweep = now
+	}
+}
+
+// expired determines whether a final result has outlived ttl
+func (rs *Store) expired(res Result, now time.Time) bool {
+
+	return res.State != STATE_QUEUED && now.Sub(res.UpdatedAt) >= rs.ttl
+}
@@ -0,0 +1,63 @@
+package result
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gptankit/serviceq/model"
+)
+
+func TestResultLifecycle(t *testing.T) {
+
+	rs := NewStore(50 * time.Millisecond)
+
+	rs.Queued("r1")
+	rs.Queued("r2")
+	rs.Delivered("r1", model.ResponseParam{Status: "201 Created"})
+
+	if res, ok := rs.Get("r1"); !ok || res.State != STATE_DELIVERED || res.Response.Status != "201 Created" {
+		t.Errorf("delivered result not stored, got %v\n", res)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if _, ok := rs.Get("r1"); ok {
+		t.Errorf("delivered result not expired after ttl\n")
+	}
+	if res, ok := rs.Get("r2"); !ok || res.State != STATE_QUEUED {
+		t.Errorf("queued result expired before reaching final state\n")
+	}
+}
+
+func TestKeyDeduplication(t *testing.T) {
+
+	ks := NewKeyStore(50 * time.Millisecond)
+	req := model.RequestParam{Method: "POST", RequestURI: "/payments"}
+
+	if _, claimed := ks.Claim("k1", Fingerprint(req), "r1"); !claimed {
+		t.Errorf("new key not claimed\n")
+	}
+	if entry, claimed := ks.Claim("k1", Fingerprint(req), "r2"); claimed || entry.RequestId != "r1" || entry.Result.State != STATE_IN_PROGRESS {
+		t.Errorf("repeated key claimed again, got %v\n", entry)
+	}
+
+	ks.Set("k1", "r2", STATE_DELIVERED, model.ResponseParam{Status: "500 Internal Server Error"})
+	ks.Set("k1", "r1", STATE_DELIVERED, model.ResponseParam{Status: "201 Created"})
+	if entry, _ := ks.Claim("k1", Fingerprint(req), "r3"); entry.Result.Response.Status != "201 Created" {
+		t.Errorf("response of key holder not stored, got %v\n", entry)
+	}
+
+	if _, claimed := ks.Claim("k2", Fingerprint(req), "r4"); !claimed {
+		t.Errorf("new key not claimed\n")
+	}
+	ks.Release("k2", "r4")
+	if _, ok := ks.Holder("k2"); ok {
+		t.Errorf("released key still held\n")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if _, claimed := ks.Claim("k1", Fingerprint(req), "r5"); !claimed {
+		t.Errorf("key not claimable after window\n")
+	}
+}
@@ -3,18 +3,28 @@ package main
 import (
 	"context"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/gptankit/serviceq/admin"
+	"github.com/gptankit/serviceq/callback"
 	"github.com/gptankit/serviceq/errorlog"
 	"github.com/gptankit/serviceq/model"
 	"github.com/gptankit/serviceq/properties"
 	"github.com/gptankit/serviceq/protocol/httpservice"
+	"github.com/gptankit/serviceq/queue"
+	"github.com/gptankit/serviceq/result"
+	"github.com/gptankit/serviceq/spool"
+	"github.com/gptankit/serviceq/wal"
 )
 
-// main sets up serviceq properties, initializes work done and request buffers,
-// and starts routines to accept new tcp connections and observe buffered requests
+// main sets up serviceq properties, opens the request queue and initializes work done buffer,
+// and starts routines to accept new tcp connections and replay buffered requests
 func main() {
 
 	ctx := context.Background()
@@ -23,17 +33,136 @@ func main() {
 
 	if sqp, err := properties.New(properties.GetFilePath()); err == nil {
 
+		q, err := queue.New(sqp)
+		if err != nil {
+			go errorlog.LogGenericError("Could not open " + sqp.QBackend + " queue -- " + err.Error())
+			return
+		}
+		defer func() { q.Close() }() // q may get wrapped below
+
+		dlq, err := queue.NewDeadLetter(sqp)
+		if err != nil {
+			go errorlog.LogGenericError("Could not open " + sqp.QBackend + " dead-letter queue -- " + err.Error())
+			return
+		}
+		defer dlq.Close()
+
+		// memory backend queues are saved on shutdown, to be picked up again here
+		snapshotQ := sqp.QBackend != queue.BACKEND_FILE && sqp.QSnapshotFile != ""
+		if snapshotQ {
+			if restored, err := queue.RestoreSnapshot(sqp.QSnapshotFile, q, dlq); err != nil {
+				go errorlog.LogGenericError("Could not restore queue snapshot -- " + err.Error())
+			} else if restored > 0 {
+				go errorlog.LogGenericError("Restored " + strconv.Itoa(restored) + " requests from queue snapshot")
+			}
+		}
+		memQ := q // snapshot what is held in memory, not what is spilled to disk
+
+		results := result.NewStore(time.Duration(sqp.QAsyncResultTTL) * time.Second)
+		var keys *result.KeyStore
+		if sqp.QIdempotencyWindow > 0 {
+			keys = result.NewKeyStore(time.Duration(sqp.QIdempotencyWindow) * time.Second)
+		}
+
+		if sqp.QMaxItems > 0 || sqp.QMaxBytes > 0 {
+			dropped := func(reqParam model.RequestParam) {
+				results.DeadLettered(reqParam.Id)
+				if keys != nil && reqParam.IdempotencyKey != "" {
+					keys.Set(reqParam.IdempotencyKey, reqParam.Id, result.STATE_DEAD_LETTERED, model.ResponseParam{})
+				}
+				spool.Release(reqParam)
+				go errorlog.LogGenericError("Dropped buffered request " + reqParam.Method + " " + reqParam.RequestURI + " to make room in queue")
+			}
+			bq, err := queue.NewBounded(sqp, q, dropped)
+			if err != nil {
+				go errorlog.LogGenericError("Could not open queue overflow -- " + err.Error())
+				return
+			}
+			q = bq
+		}
+
+		if compactor, ok := q.(queue.Compactor); ok && sqp.QCompactBy != "" {
+			compactor.Compact(func(reqParam model.RequestParam) {
+				results.Superseded(reqParam.Id)
+				if keys != nil && reqParam.IdempotencyKey != "" {
+					keys.Set(reqParam.IdempotencyKey, reqParam.Id, result.STATE_SUPERSEDED, model.ResponseParam{})
+				}
+				spool.Release(reqParam)
+			})
+		}
+
+		restored := q.List() // replayed before new connections are accepted
+		for _, reqParam := range restored {
+			results.Queued(reqParam.Id)
+			if keys != nil && reqParam.IdempotencyKey != "" {
+				keys.Claim(reqParam.IdempotencyKey, result.Fingerprint(reqParam), reqParam.Id)
+				keys.Set(reqParam.IdempotencyKey, reqParam.Id, result.STATE_QUEUED, model.ResponseParam{})
+			}
+		}
+
+		httpSrvOptions := []httpservice.HTTPServiceOption{
+			httpservice.WithShutdown(stopCtx),
+			httpservice.WithDeadLetterQueue(dlq),
+			httpservice.WithResultStore(results),
+		}
+		if keys != nil {
+			httpSrvOptions = append(httpSrvOptions, httpservice.WithKeyStore(keys))
+		}
+		if sqp.BodySpoolThreshold > 0 {
+			fsync, _ := wal.ParseFsyncPolicy(sqp.QWALFsync)
+			durable := sqp.QBackend == queue.BACKEND_FILE && fsync != wal.FsyncNever
+			spooler, err := spool.New(sqp.BodySpoolDir, sqp.BodySpoolThreshold, durable)
+			if err != nil {
+				go errorlog.LogGenericError("Could not open body spool -- " + err.Error())
+				return
+			}
+			spooler.Clean(append(q.List(), dlq.List()...)) // bodies of requests lost with the previous run
+			httpSrvOptions = append(httpSrvOptions, httpservice.WithSpooler(spooler))
+		}
+		if sqp.QDrainRate > 0 {
+			drain := queue.NewDrainLimiter(float64(sqp.QDrainRate), time.Duration(sqp.QDrainRamp)*time.Second)
+			httpSrvOptions = append(httpSrvOptions, httpservice.WithDrainLimiter(drain))
+		}
+		if sqp.QCallbackEnabled {
+			httpSrvOptions = append(httpSrvOptions, httpservice.WithCallbackDispatcher(callback.NewDispatcher(sqp)))
+		}
+
 		if ln, err := newListener(sqp); err == nil {
 			defer closeListener(ln)
 
-			cwork := make(chan int, sqp.MaxConcurrency+1)      // work done queue
-			creq := make(chan interface{}, sqp.MaxConcurrency) // request queue
+			cwork := make(chan int, sqp.MaxConcurrency+1) // work done queue
+
+			// requests in flight go on after stop signal, until drained or aborted on shutdown timeout
+			workCtx, abort := context.WithCancel(ctx)
+			defer abort()
+			var inFlight sync.WaitGroup
+
+			// replay buffered requests
+			workBackground(workCtx, &inFlight, q, sqp, httpSrvOptions...)
+
+			// serve admin api
+			if sqp.AdminListenerPort != "" {
+				adminOptions := []admin.AdminOption{admin.WithResultStore(results)}
+				if keys != nil {
+					adminOptions = append(adminOptions, admin.WithKeyStore(keys))
+				}
+				go listenAdmin(stopCtx, q, dlq, sqp, adminOptions...)
+			}
 
-			// observe buffered requests
-			go workBackground(stopCtx, creq, cwork, sqp)
+			// accept new connections, once restored requests are delivered or dead-lettered
+			go func() {
+				<-stopCtx.Done()
+				closeListener(ln)
+			}()
+			awaitRestored(stopCtx, q, restored, time.Duration(sqp.QStartupReplayTimeout)*time.Second)
+			listenActive(workCtx, &inFlight, ln, q, cwork, sqp, httpSrvOptions...)
 
-			// accept new connections
-			listenActive(stopCtx, ln, creq, cwork, sqp)
+			drainInFlight(&inFlight, time.Duration(sqp.ShutdownTimeout)*time.Second, abort)
+			if snapshotQ {
+				if err := queue.SaveSnapshot(sqp.QSnapshotFile, memQ, dlq); err != nil {
+					go errorlog.LogGenericError("Could not save queue snapshot -- " + err.Error())
+				}
+			}
 		} else {
 			go errorlog.LogGenericError("Could not listen on :" + sqp.ListenerPort + " -- " + err.Error())
 		}
@@ -42,22 +171,21 @@ func main() {
 	}
 }
 
-// listenActive forwards new requests to the cluster
-func listenActive(ctx context.Context, ln *net.Listener, creq chan interface{}, cwork chan int, sqp *model.ServiceQProperties) {
-
-	shutListener := func(ln *net.Listener) {
-		<-ctx.Done()
-		closeListener(ln)
-	}
-	go shutListener(ln)
+// listenActive forwards new requests to the cluster until ln is closed, connections are tracked in inFlight
+func listenActive(ctx context.Context, inFlight *sync.WaitGroup, ln *net.Listener, q model.Queue, cwork chan int, sqp *model.ServiceQProperties, httpSrvOptions ...httpservice.HTTPServiceOption) {
 
 	for {
 		if conn, err := (*ln).Accept(); err == nil {
 			if len(cwork) < cap(cwork)-1 {
 				switch sqp.Proto {
 				case "http":
-					if httpSrv := httpservice.New(sqp, httpservice.WithIncomingTCPConn(&conn)); httpSrv != nil {
-						go httpSrv.ExecuteRealTime(ctx, creq, cwork)
+					connOptions := append([]httpservice.HTTPServiceOption{httpservice.WithIncomingTCPConn(&conn)}, httpSrvOptions...)
+					if httpSrv := httpservice.New(sqp, connOptions...); httpSrv != nil {
+						inFlight.Add(1)
+						go func() {
+							defer inFlight.Done()
+							httpSrv.ExecuteRealTime(ctx, q, cwork)
+						}()
 					}
 				default:
 					conn.Close()
@@ -76,15 +204,103 @@ func listenActive(ctx context.Context, ln *net.Listener, creq chan interface{},
 	}
 }
 
-// workBackground forwards buffered requests to the cluster
-func workBackground(ctx context.Context, creq chan interface{}, cwork chan int, sqp *model.ServiceQProperties) {
+// workBackground starts Q_REPLAY_WORKERS workers forwarding buffered requests to the cluster until
+// shutdown (or ctx is done), workers are tracked in inFlight
+func workBackground(ctx context.Context, inFlight *sync.WaitGroup, q model.Queue, sqp *model.ServiceQProperties, httpSrvOptions ...httpservice.HTTPServiceOption) {
 
 	switch sqp.Proto {
 	case "http":
-		if httpSrv := httpservice.New(sqp); httpSrv != nil {
-			go httpSrv.ExecuteBuffered(ctx, creq, cwork)
+		for i := 0; i < sqp.QReplayWorkers; i++ {
+			if httpSrv := httpservice.New(sqp, httpSrvOptions...); httpSrv != nil {
+				inFlight.Add(1)
+				go func() {
+					defer inFlight.Done()
+					httpSrv.ExecuteBuffered(ctx, q)
+				}()
+			}
 		}
 	default:
 		break
 	}
 }
+
+// awaitRestored waits for requests restored on startup to leave q, delivered or dead-lettered, until
+// timeout or ctx is done. Requests deferred to a later delivery time are not waited for.
+func awaitRestored(ctx context.Context, q model.Queue, restored []model.RequestParam, timeout time.Duration) {
+
+	now := time.Now()
+	pending := make(map[uint64]bool, len(restored))
+	for _, reqParam := range restored {
+		if !reqParam.DeliverAt.After(now) {
+			pending[reqParam.Seq] = true
+		}
+	}
+	if len(pending) == 0 || timeout == 0 {
+		return
+	}
+	go errorlog.LogGenericError("Replaying " + strconv.Itoa(len(pending)) + " restored requests before accepting connections")
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+
+	for {
+		left := 0
+		for _, reqParam := range q.List() {
+			if pending[reqParam.Seq] {
+				left++
+			}
+		}
+		if left == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			go errorlog.LogGenericError("Startup replay timeout reached with " + strconv.Itoa(left) + " restored requests left, accepting connections")
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+// drainInFlight waits for connections and workers to finish their requests, those still
+// in flight after timeout are aborted (and buffered) through abort
+func drainInFlight(inFlight *sync.WaitGroup, timeout time.Duration, abort context.CancelFunc) {
+
+	drained := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		go errorlog.LogGenericError("Shutdown timeout reached, aborting requests in flight")
+		abort()
+		<-drained
+	}
+}
+
+// listenAdmin serves the admin api on a separate port until ctx is done
+func listenAdmin(ctx context.Context, q model.Queue, dlq model.Queue, sqp *model.ServiceQProperties, adminOptions ...admin.AdminOption) {
+
+	adminSrv := &http.Server{
+		Addr:    net.JoinHostPort(sqp.AdminListenerHost, sqp.AdminListenerPort),
+		Handler: admin.New(sqp, q, dlq, adminOptions...),
+	}
+
+	shutAdmin := func() {
+		<-ctx.Done()
+		adminSrv.Close()
+	}
+	go shutAdmin()
+
+	if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		go errorlog.LogGenericError("Could not listen on admin :" + sqp.AdminListenerPort + " -- " + err.Error())
+	}
+}
@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gptankit/serviceq/model"
+	"github.com/gptankit/serviceq/queue"
 )
 
 func TestWorkAssigment(t *testing.T) {
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
 
 	// assumption -- all services are down
 
@@ -23,18 +25,19 @@ func TestWorkAssigment(t *testing.T) {
 			{RawUrl: "http://example.org:4001", Scheme: "http", QualifiedUrl: "http://example.org:4001", Host: "example.org:4001"},
 			{RawUrl: "http://example.org:5001", Scheme: "http", QualifiedUrl: "http://example.org:5001", Host: "example.org:5001"},
 		},
-		MaxConcurrency:    8, // if changing, do check value of duplicateWork
+		MaxConcurrency:    8,
 		EnableDeferredQ:   true,
-		QRequestFormats:   []string{"ALL"},
-		MaxRetries:        1,   // we know it's down
-		RetryGap:          0,   // ms
-		IdleGap:           500, // ms
-		RequestErrorLog:   make(map[string]uint64, 2),
+		QRequestRules:     []model.RequestRule{{Priority: model.PRIORITY_NORMAL}},
+		MaxRetries:        1, // we know it's down
+		RetryGap:          0, // ms
+		ErrorScores:       make(map[string]model.ErrorScore, 2),
 		OutRequestTimeout: 1,
+		QReplayWorkers:    2,
+		QReplayBackoff:    10, // ms
+		QReplayBackoffMax: 50, // ms
 	}
 
-	cw := make(chan int, sqp.MaxConcurrency)
-	cr := make(chan interface{}, sqp.MaxConcurrency)
+	q := queue.NewMemoryQueue()
 
 	reqParam := model.RequestParam{
 		Protocol:   "HTTP/1.1",
@@ -45,37 +48,35 @@ func TestWorkAssigment(t *testing.T) {
 		},
 		BodyBuff: nil,
 	}
-	cr <- reqParam
-	cw <- 1
-
-	go workBackground(ctx, cr, cw, &sqp) // this will start executing req
-
-	// increment/decrement buffer (+1/-1) in creq, cwork and give time to orchestrate
+	for i := 0; i < 3; i++ {
+		q.Enqueue(reqParam)
+	}
 
-	duplicateWork := int(sqp.MaxConcurrency/2) + 1
+	var inFlight sync.WaitGroup
+	workBackground(ctx, &inFlight, q, &sqp) // this will start replaying reqs
 
-	time.Sleep(1000 * time.Millisecond)
-	// add req and work again
-	for i := 0; i < duplicateWork; i++ {
-		cr <- reqParam
-		cw <- 1
+	time.Sleep(3000 * time.Millisecond)
+	cancel()
+	drainInFlight(&inFlight, 1500*time.Millisecond, cancel) // let replays in flight finish
+
+	attempts := func() int {
+		n := 0
+		for _, reqParam := range q.List() {
+			if reqParam.Attempts == 0 {
+				t.Errorf("Buffered request not replayed\n")
+			}
+			n += reqParam.Attempts
+		}
+		return n
 	}
 
-	time.Sleep(1000 * time.Millisecond)
-	// remove all work without removing req
-	for i := 0; i < duplicateWork+1; i++ {
-		<-cw
+	if q.Len() != 3 {
+		t.Errorf("Buffered requests lost, expected 3, got %d\n", q.Len())
 	}
 
+	before := attempts()
 	time.Sleep(1000 * time.Millisecond)
-	// add half of works
-	for i := 0; i < ((duplicateWork + 1) / 2); i++ {
-		cw <- 1
-	}
-
-	time.Sleep(3000 * time.Millisecond)
-
-	if len(cw) < ((duplicateWork+1)/2)-1 || len(cw) > ((duplicateWork+1)/2) {
-		t.Errorf("Work not being orchestrated properly\n")
+	if after := attempts(); after != before {
+		t.Errorf("Workers not stopped with ctx, attempts went from %d to %d\n", before, after)
 	}
 }
@@ -0,0 +1,119 @@
+// Package spool keeps large request bodies in files instead of memory.
+package spool
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gptankit/serviceq/model"
+)
+
+const filePattern = "body-*"
+
+// Spooler reads request bodies into memory up to threshold bytes, larger bodies are written to files in dir
+type Spooler struct {
+	dir       string
+	threshold int64
+	durable   bool // dir is synced too, so that spooled bodies survive a crash along with a durable queue
+}
+
+// New returns a Spooler writing bodies larger than threshold bytes to dir, durable if bodies must
+// survive a crash (queue backed by a synced write-ahead log)
+func New(dir string, threshold int64, durable bool) (*Spooler, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Spooler{dir: dir, threshold: threshold, durable: durable}, nil
+}
+
+// Save reads body into request, into BodyBuff if it is within threshold, or else into BodyFile
+func (sp *Spooler) Save(reqParam *model.RequestParam, body io.Reader) error {
+
+	head, err := ioutil.ReadAll(io.LimitReader(body, sp.threshold+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(head)) <= sp.threshold {
+		reqParam.BodyBuff = head
+		return nil
+	}
+
+	file, err := ioutil.TempFile(sp.dir, filePattern)
+	if err != nil {
+		return err
+	}
+
+	// body must be on disk before the request referring to it is logged
+	size, err := io.Copy(file, io.MultiReader(bytes.NewReader(head), body))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && sp.durable {
+		err = syncDir(sp.dir)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	reqParam.BodyFile = file.Name()
+	reqParam.BodySize = size
+
+	return nil
+}
+
+// Clean removes spooled bodies not referenced by any of the given requests, left behind by a previous run
+func (sp *Spooler) Clean(reqParams []model.RequestParam) {
+
+	referenced := make(map[string]bool, len(reqParams))
+	for _, reqParam := range reqParams {
+		if reqParam.BodyFile != "" {
+			referenced[reqParam.BodyFile] = true
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(sp.dir, filePattern))
+	for _, file := range files {
+		if !referenced[file] {
+			os.Remove(file)
+		}
+	}
+}
+
+// Open returns a fresh reader over request body, from memory or from its spooled file
+func Open(reqParam model.RequestParam) (io.ReadCloser, error) {
+
+	if reqParam.BodyFile == "" {
+		return ioutil.NopCloser(bytes.NewReader(reqParam.BodyBuff)), nil
+	}
+
+	return os.Open(reqParam.BodyFile)
+}
+
+// Release removes spooled body of a request that is done with
+func Release(reqParam model.RequestParam) {
+
+	if reqParam.BodyFile != "" {
+		os.Remove(reqParam.BodyFile)
+	}
+}
+
+// syncDir flushes dir entries, so that files created in dir are found after a crash
+func syncDir(dir string) error {
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
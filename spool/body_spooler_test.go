@@ -0,0 +1,68 @@
+package spool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gptankit/serviceq/model"
+)
+
+func TestSpooling(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp, err := New(dir, 8, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := model.RequestParam{}
+	if err := sp.Save(&small, strings.NewReader("tiny")); err != nil {
+		t.Fatal(err)
+	}
+	if small.BodyFile != "" || string(small.BodyBuff) != "tiny" {
+		t.Errorf("Small body should be kept in memory")
+	}
+
+	large := model.RequestParam{}
+	if err := sp.Save(&large, strings.NewReader("somewhat larger body")); err != nil {
+		t.Fatal(err)
+	}
+	if large.BodyFile == "" || large.BodyBuff != nil || large.BodySize != 20 {
+		t.Errorf("Large body should be spooled to file")
+	}
+
+	// every open reads body from start, as on every delivery attempt
+	for i := 0; i < 2; i++ {
+		body, err := Open(large)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(body); string(b) != "somewhat larger body" {
+			t.Errorf("Expected spooled body, got %q", b)
+		}
+		body.Close()
+	}
+
+	orphan := model.RequestParam{}
+	sp.Save(&orphan, strings.NewReader("left behind by crash"))
+	sp.Clean([]model.RequestParam{small, large})
+	if _, err := os.Stat(orphan.BodyFile); !os.IsNotExist(err) {
+		t.Errorf("Unreferenced body should be cleaned")
+	}
+	if _, err := os.Stat(large.BodyFile); err != nil {
+		t.Errorf("Referenced body should be kept")
+	}
+
+	Release(large)
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("Expected no spooled bodies after release, got %d", len(files))
+	}
+}
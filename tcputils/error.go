@@ -11,11 +11,14 @@ const (
 	UPSTREAM_NO_ERR      = 700
 	UPSTREAM_TCP_ERR     = 701
 	UPSTREAM_HTTP_ERR    = 702
+	UPSTREAM_STATUS_ERR  = 703
 
 	RESPONSE_FLOODED      = "SERVICEQ_FLOODED"
 	RESPONSE_TIMED_OUT    = "UPSTREAM_TIMED_OUT"
 	RESPONSE_SERVICE_DOWN = "UPSTREAM_DOWN"
 	RESPONSE_NO_RESPONSE  = "UPSTREAM_NO_RESPONSE"
+	RESPONSE_FAILED       = "UPSTREAM_FAILED"       // answered with a status listed in UPSTREAM_FAILURE_STATUS
+	RESPONSE_CIRCUIT_OPEN = "UPSTREAM_CIRCUIT_OPEN" // circuit to the node is open, no request was sent
 )
 
 // EvalError evaluates the type of errors from upstream node
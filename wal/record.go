@@ -0,0 +1,84 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	recordPut = byte(1) // payload for a sequence number (latest one wins)
+	recordAck = byte(2) // sequence number delivered, payload is empty
+
+	recordHeaderSize = 4 + 4 + 1 + 8 // length, checksum, type, seq
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptRecord = errors.New("corrupt-record")
+)
+
+// record is a single entry in a log segment
+type record struct {
+	kind    byte
+	seq     uint64
+	payload []byte
+}
+
+// size returns the number of bytes a record occupies on disk
+func (rec record) size() int64 {
+
+	return int64(recordHeaderSize + len(rec.payload))
+}
+
+// encode serializes a record as [length][crc32c][type][seq][payload], where length
+// covers type, seq and payload and the checksum is computed over the same bytes.
+func (rec record) encode() []byte {
+
+	buf := make([]byte, rec.size())
+	body := buf[8:]
+	body[0] = rec.kind
+	binary.BigEndian.PutUint64(body[1:9], rec.seq)
+	copy(body[9:], rec.payload)
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(body, crcTable))
+
+	return buf
+}
+
+// readRecord reads the next record from reader. io.EOF is returned on a clean segment
+// end, errCorruptRecord on a torn write or checksum mismatch.
+func readRecord(reader *bufio.Reader) (record, error) {
+
+	head := make([]byte, 8)
+	if n, err := io.ReadFull(reader, head); err != nil {
+		if err == io.EOF && n == 0 {
+			return record{}, io.EOF
+		}
+		return record{}, errCorruptRecord
+	}
+
+	length := binary.BigEndian.Uint32(head[0:4])
+	if length < 9 {
+		return record{}, errCorruptRecord
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return record{}, errCorruptRecord
+	}
+
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(head[4:8]) {
+		return record{}, errCorruptRecord
+	}
+
+	return record{
+		kind:    body[0],
+		seq:     binary.BigEndian.Uint64(body[1:9]),
+		payload: body[9:],
+	}, nil
+}
@@ -0,0 +1,81 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const segmentExt = ".wal"
+
+// segment is a single append-only file of the log. Only the last (active)
+// segment is open for writing, older segments are read when replaying or compacting.
+type segment struct {
+	base uint64 // sequence number the segment was created at, used as file name
+	path string
+	file *os.File
+	size int64
+	puts int // put records stored in segment
+	live int // put records in segment that are the latest version of a pending entry
+}
+
+// segmentPath returns file path of a segment with given base in dir
+func segmentPath(dir string, base uint64) string {
+
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, segmentExt))
+}
+
+// listSegments returns segments found in dir ordered by base
+func listSegments(dir string) ([]*segment, error) {
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*segment
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, &segment{base: base, path: filepath.Join(dir, name)})
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].base < segments[j].base })
+
+	return segments, nil
+}
+
+// readAt reads a single record stored at offset in segment
+func (seg *segment) readAt(off int64, size int64) (record, error) {
+
+	file := seg.file
+	if file == nil {
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return record{}, err
+		}
+		defer f.Close()
+		file = f
+	}
+
+	buf := make([]byte, size)
+	if _, err := file.ReadAt(buf, off); err != nil {
+		return record{}, err
+	}
+
+	return record{
+		kind:    buf[8],
+		seq:     binary.BigEndian.Uint64(buf[9:recordHeaderSize]),
+		payload: buf[recordHeaderSize:],
+	}, nil
+}
@@ -0,0 +1,453 @@
+// Package wal implements a segmented, checksummed, append-only log that
+// persists queued entries until they are acknowledged as delivered.
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy decides when appended records are flushed to stable storage
+type FsyncPolicy int
+
+const (
+	FsyncAlways   FsyncPolicy = iota // fsync on every append/ack
+	FsyncInterval                    // fsync periodically, every FsyncInterval
+	FsyncNever                       // leave flushing to the operating system
+)
+
+// ParseFsyncPolicy maps always/interval/never to corresponding FsyncPolicy
+func ParseFsyncPolicy(policy string) (FsyncPolicy, error) {
+
+	switch strings.ToLower(policy) {
+	case "always":
+		return FsyncAlways, nil
+	case "interval", "":
+		return FsyncInterval, nil
+	case "never":
+		return FsyncNever, nil
+	default:
+		return FsyncInterval, errors.New("invalid-fsync-policy")
+	}
+}
+
+// Options controls segment rolling, flushing and compaction of the log
+type Options struct {
+	SegmentSize   int64         // bytes after which a new segment is started
+	Fsync         FsyncPolicy   // flush policy
+	FsyncInterval time.Duration // flush period for FsyncInterval
+	CompactRatio  float64       // oldest segment is rewritten once its live/total ratio drops to or below this
+}
+
+// Entry is a pending (appended but not acknowledged) log entry
+type Entry struct {
+	Seq     uint64
+	Payload []byte
+}
+
+// location points to the latest put record of a pending entry
+type location struct {
+	seg  *segment
+	off  int64
+	size int64
+}
+
+// Log is a durable queue log. Appended entries stay pending until acknowledged,
+// and segments that only hold delivered entries are removed by compaction.
+type Log struct {
+	dir        string
+	opts       Options
+	mu         sync.Mutex
+	segments   []*segment
+	locs       map[uint64]location
+	nextSeq    uint64
+	dirty      bool
+	compacting bool
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// Open opens (or creates) the log in dir and recovers pending entries from existing
+// segments. A torn or corrupt record ends recovery of its segment, and the active
+// segment is truncated to the last valid record.
+func Open(dir string, opts Options) (*Log, error) {
+
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 64 << 20
+	}
+	if opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = time.Second
+	}
+	if opts.CompactRatio <= 0 {
+		opts.CompactRatio = 0.5
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:      dir,
+		opts:     opts,
+		segments: segments,
+		locs:     make(map[uint64]location),
+		nextSeq:  1,
+	}
+
+	for i, seg := range segments {
+		if err := l.recover(seg, i == len(segments)-1); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(l.segments) == 0 {
+		if err := l.addSegment(l.nextSeq); err != nil {
+			return nil, err
+		}
+	} else {
+		active := l.active()
+		if active.base >= l.nextSeq {
+			l.nextSeq = active.base
+		}
+		file, err := os.OpenFile(active.path, os.O_RDWR|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		active.file = file
+	}
+
+	if l.opts.Fsync == FsyncInterval {
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+		go l.syncPeriodically()
+	}
+
+	return l, nil
+}
+
+// recover replays records of a segment into the pending index
+func (l *Log) recover(seg *segment, isLast bool) error {
+
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	off := int64(0)
+	for {
+		rec, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if isLast {
+				return os.Truncate(seg.path, off)
+			}
+			break
+		}
+
+		switch rec.kind {
+		case recordPut:
+			l.track(rec.seq, location{seg: seg, off: off, size: rec.size()})
+		case recordAck:
+			l.untrack(rec.seq)
+		}
+		if rec.seq >= l.nextSeq {
+			l.nextSeq = rec.seq + 1
+		}
+
+		off += rec.size()
+		seg.size = off
+	}
+
+	return nil
+}
+
+// Append writes a new entry to the log and returns its sequence number
+func (l *Log) Append(payload []byte) (uint64, error) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seq := l.nextSeq
+	if err := l.write(record{kind: recordPut, seq: seq, payload: payload}); err != nil {
+		return 0, err
+	}
+	l.nextSeq++
+
+	return seq, nil
+}
+
+// Update replaces the payload of a pending entry, keeping its sequence number
+func (l *Log) Update(seq uint64, payload []byte) error {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.locs[seq]; !ok {
+		return errors.New("unknown-seq")
+	}
+
+	return l.write(record{kind: recordPut, seq: seq, payload: payload})
+}
+
+// Ack marks a pending entry as delivered. Acking an unknown entry is a no-op.
+func (l *Log) Ack(seq uint64) error {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.locs[seq]; !ok {
+		return nil
+	}
+
+	return l.write(record{kind: recordAck, seq: seq})
+}
+
+// Pending returns all pending entries ordered by sequence number
+func (l *Log) Pending() ([]Entry, error) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]Entry, 0, len(l.locs))
+	for seq, loc := range l.locs {
+		rec, err := loc.seg.readAt(loc.off, loc.size)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{Seq: seq, Payload: rec.payload})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+
+	return entries, nil
+}
+
+// Len returns the number of pending entries
+func (l *Log) Len() int {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.locs)
+}
+
+// Compact removes segments holding only delivered entries, and rewrites pending
+// entries of the oldest segment forward once it is sparse enough.
+func (l *Log) Compact() error {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.compact()
+}
+
+// Sync flushes the active segment to stable storage
+func (l *Log) Sync() error {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.sync()
+}
+
+// Close flushes and closes the log
+func (l *Log) Close() error {
+
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.sync(); err != nil {
+		return err
+	}
+
+	return l.active().file.Close()
+}
+
+// active returns the segment currently written to
+func (l *Log) active() *segment {
+
+	return l.segments[len(l.segments)-1]
+}
+
+// track points seq to its latest put record, retiring the previous one
+func (l *Log) track(seq uint64, loc location) {
+
+	l.untrack(seq)
+	loc.seg.puts++
+	loc.seg.live++
+	l.locs[seq] = loc
+}
+
+// untrack removes seq from the pending index
+func (l *Log) untrack(seq uint64) {
+
+	if prev, ok := l.locs[seq]; ok {
+		prev.seg.live--
+		delete(l.locs, seq)
+	}
+}
+
+// write appends a record to the active segment, rolling it over when full
+func (l *Log) write(rec record) error {
+
+	active := l.active()
+	if active.size > 0 && active.size+rec.size() > l.opts.SegmentSize {
+		if err := l.roll(); err != nil {
+			return err
+		}
+		active = l.active()
+	}
+
+	off := active.size
+	if _, err := active.file.Write(rec.encode()); err != nil {
+		return err
+	}
+	active.size += rec.size()
+
+	switch rec.kind {
+	case recordPut:
+		l.track(rec.seq, location{seg: active, off: off, size: rec.size()})
+	case recordAck:
+		l.untrack(rec.seq)
+	}
+
+	if l.opts.Fsync == FsyncAlways {
+		return active.file.Sync()
+	}
+	l.dirty = true
+
+	return nil
+}
+
+// roll closes the active segment, starts a new one and compacts the log
+func (l *Log) roll() error {
+
+	active := l.active()
+	if err := active.file.Sync(); err != nil {
+		return err
+	}
+	if err := active.file.Close(); err != nil {
+		return err
+	}
+	active.file = nil
+
+	base := l.nextSeq
+	if base <= active.base {
+		base = active.base + 1
+	}
+	if err := l.addSegment(base); err != nil {
+		return err
+	}
+
+	return l.compact()
+}
+
+// addSegment creates a new active segment
+func (l *Log) addSegment(base uint64) error {
+
+	seg := &segment{base: base, path: segmentPath(l.dir, base)}
+	file, err := os.OpenFile(seg.path, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	seg.file = file
+	l.segments = append(l.segments, seg)
+
+	return nil
+}
+
+// compact drops fully delivered segments from the head of the log. Only a prefix is
+// removed, so that ack records never outlive the put records they refer to.
+func (l *Log) compact() error {
+
+	if l.compacting {
+		return nil
+	}
+	l.compacting = true
+	defer func() { l.compacting = false }()
+
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+		if oldest.live > 0 {
+			if float64(oldest.live)/float64(oldest.puts) > l.opts.CompactRatio {
+				break
+			}
+			var seqs []uint64
+			for seq, loc := range l.locs {
+				if loc.seg == oldest {
+					seqs = append(seqs, seq)
+				}
+			}
+			sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+			for _, seq := range seqs {
+				loc := l.locs[seq]
+				rec, err := oldest.readAt(loc.off, loc.size)
+				if err != nil {
+					return err
+				}
+				if err := l.write(record{kind: recordPut, seq: seq, payload: rec.payload}); err != nil {
+					return err
+				}
+			}
+			if err := l.sync(); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+
+	return nil
+}
+
+// sync flushes the active segment if there are unflushed writes
+func (l *Log) sync() error {
+
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+
+	return l.active().file.Sync()
+}
+
+// syncPeriodically flushes the log every FsyncInterval until closed
+func (l *Log) syncPeriodically() {
+
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.opts.FsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.Sync()
+		case <-l.stop:
+			return
+		}
+	}
+}
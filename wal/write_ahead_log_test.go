@@ -0,0 +1,94 @@
+package wal
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReplayPendingAfterReopen(t *testing.T) {
+
+	dir := t.TempDir()
+
+	l, err := Open(dir, Options{Fsync: FsyncAlways})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s1, _ := l.Append([]byte("r1"))
+	s2, _ := l.Append([]byte("r2"))
+	s3, _ := l.Append([]byte("r3"))
+	l.Ack(s2)
+	l.Update(s3, []byte("r3-updated"))
+	l.Close()
+
+	l, err = Open(dir, Options{Fsync: FsyncAlways})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	entries, _ := l.Pending()
+	if len(entries) != 2 || entries[0].Seq != s1 || entries[1].Seq != s3 || string(entries[1].Payload) != "r3-updated" {
+		t.Errorf("pending entries not replayed properly, got %v\n", entries)
+	}
+
+	if s4, _ := l.Append([]byte("r4")); s4 <= s3 {
+		t.Errorf("sequence reused after reopen, s3=%d --> s4=%d\n", s3, s4)
+	}
+}
+
+func TestTornWriteIsTruncated(t *testing.T) {
+
+	dir := t.TempDir()
+
+	l, _ := Open(dir, Options{Fsync: FsyncAlways})
+	l.Append([]byte("r1"))
+	l.Append([]byte("r2"))
+	path := l.active().path
+	l.Close()
+
+	// chop off part of the last record
+	fileStat, _ := os.Stat(path)
+	os.Truncate(path, fileStat.Size()-3)
+
+	l, err := Open(dir, Options{Fsync: FsyncAlways})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	entries, _ := l.Pending()
+	if len(entries) != 1 || string(entries[0].Payload) != "r1" {
+		t.Errorf("torn record not discarded, got %v\n", entries)
+	}
+}
+
+func TestCompactionRemovesDeliveredSegments(t *testing.T) {
+
+	dir := t.TempDir()
+	opts := Options{SegmentSize: 64, Fsync: FsyncNever}
+
+	l, _ := Open(dir, opts)
+	var seqs []uint64
+	for i := 0; i < 20; i++ {
+		seq, _ := l.Append([]byte("request"))
+		seqs = append(seqs, seq)
+	}
+	for _, seq := range seqs[:19] {
+		l.Ack(seq)
+	}
+	l.Compact()
+
+	if len(l.segments) > 3 {
+		t.Errorf("delivered segments not compacted, segments=%d\n", len(l.segments))
+	}
+	l.Close()
+
+	l, _ = Open(dir, opts)
+	defer l.Close()
+
+	entries, _ := l.Pending()
+	if len(entries) != 1 || entries[0].Seq != seqs[19] {
+		t.Errorf("pending entry lost on compaction, got %v\n", entries)
+	}
+}